@@ -0,0 +1,205 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//Batch groups the messages the server sent between BATCH +ref and BATCH -ref
+//(ircv3 batch), like a netsplit or the reply to a labelled command
+type Batch struct {
+	Ref      string
+	Type     string
+	Params   []string
+	Start    *IrcMessage   //the BATCH +ref line, with its tags
+	Messages []*IrcMessage //in the batch itself, in the order received
+	Batches  []*Batch      //nested in this one
+	parent   *Batch
+}
+
+//Response is everything the server sent back for a labelled command: either
+//a single message, possibly an ACK, or a batch
+type Response struct {
+	Label    string
+	Messages []*IrcMessage
+	Batch    *Batch
+}
+
+type batchTracker struct {
+	lock      *sync.Mutex
+	open      map[string]*Batch //by reference, nested ones too
+	labels    map[string]chan *Response
+	lastLabel int64
+	listeners *notifier
+}
+
+func newBatchTracker() *batchTracker {
+	return &batchTracker{new(sync.Mutex), make(map[string]*Batch), make(map[string]chan *Response), 0, newNotifier()}
+}
+
+//newLabel returns a label no other command of the connection was given
+func (b *batchTracker) newLabel() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lastLabel++
+	return fmt.Sprintf("ic%d", b.lastLabel)
+}
+
+//expect returns a new label and the channel its response will be sent on
+func (b *batchTracker) expect() (string, chan *Response) {
+	label := b.newLabel()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ch := make(chan *Response, 1)
+	b.labels[label] = ch
+	return label, ch
+}
+
+func (b *batchTracker) forget(label string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.labels[label] = nil, false
+}
+
+//receiving tells whether the labelled batch answering label has started
+func (b *batchTracker) receiving(label string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, batch := range b.open {
+		if batch.parent == nil && batch.Start.Tags["label"] == label {
+			return true
+		}
+	}
+	return false
+}
+
+//respond hands a response to the command waiting for it, the caller must
+//hold the lock
+func (b *batchTracker) respond(r *Response) {
+	if ch, ok := b.labels[r.Label]; ok {
+		ch <- r //buffered, there's a single response per label
+		b.labels[r.Label] = nil, false
+	}
+}
+
+//reset drops the unfinished batches and fails the labelled commands waiting
+//for a response
+func (b *batchTracker) reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.open = make(map[string]*Batch)
+	for label, ch := range b.labels {
+		close(ch)
+		b.labels[label] = nil, false
+	}
+}
+
+//add files msg in its batch. Completed top level batches are given to the
+//labelled command they answer, or to the batch listeners.
+func (b *batchTracker) add(msg *IrcMessage) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if msg.Cmd == "BATCH" && len(msg.Params) > 0 && len(msg.Params[0]) > 1 {
+		ref := msg.Params[0][1:]
+		switch msg.Params[0][0] {
+		case '+':
+			batch := &Batch{Ref: ref, Start: msg, Messages: make([]*IrcMessage, 0), Batches: make([]*Batch, 0)}
+			if len(msg.Params) > 1 {
+				batch.Type = msg.Params[1]
+				batch.Params = msg.Params[2:]
+			}
+			if parent, ok := b.open[msg.Tags["batch"]]; ok {
+				batch.parent = parent
+				parent.Batches = append(parent.Batches, batch)
+			}
+			b.open[ref] = batch
+		case '-':
+			batch, ok := b.open[ref]
+			if !ok {
+				return
+			}
+			b.open[ref] = nil, false
+			if batch.parent != nil {
+				return
+			}
+			if label, ok := batch.Start.Tags["label"]; ok {
+				b.respond(&Response{label, nil, batch})
+				return
+			}
+			b.listeners.notify(batch)
+		}
+		return
+	}
+	if batch, ok := b.open[msg.Tags["batch"]]; ok {
+		batch.Messages = append(batch.Messages, msg)
+		return
+	}
+	if label, ok := msg.Tags["label"]; ok {
+		b.respond(&Response{label, []*IrcMessage{msg}, nil})
+	}
+}
+
+//RegBatchListener registers ch to receive the batches that don't answer a
+//labelled command (netsplits, netjoins, chat history...), once complete.
+//Batches are dropped when ch isn't ready.
+func (n *Network) RegBatchListener(ch chan *Batch) (*Subscription, os.Error) {
+	if ch == nil {
+		return nil, os.NewError("Can't register batch listener: nil channel")
+	}
+	return n.batches.listeners.add(ch, func(v interface{}) bool {
+		ok := ch <- v.(*Batch)
+		return ok
+	}, func() { close(ch) }), nil
+}
+
+//Labeled sends msg with a label (ircv3 labeled-response) and returns what
+//the server sent back for it. A batch being received isn't cut by the timeout.
+//The commands with their own method, like Whois, are labelled by themselves.
+func (n *Network) Labeled(msg *IrcMessage) (*Response, os.Error) {
+	if !n.CapEnabled("labeled-response") {
+		return nil, os.NewError("Can't label command: labeled-response isn't enabled")
+	}
+	label, ch := n.batches.expect()
+	if err := n.Send(msg.withTag("label", label)); err != nil { //dropped by an interceptor
+		n.batches.forget(label)
+		return nil, err
+	}
+	ticker := time.NewTicker(n.timeout())
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-ch:
+			if r == nil {
+				return nil, os.NewError(fmt.Sprintf("Disconnected waiting for the response to %s", msg.Cmd))
+			}
+			return r, nil
+		case <-ticker.C:
+			if !n.batches.receiving(label) {
+				n.batches.forget(label)
+				return nil, os.NewError(fmt.Sprintf("No response to %s", msg.Cmd))
+			}
+		}
+	}
+	return nil, nil
+}
+
+//batcher groups the messages of the server in their batches
+func (n *Network) batcher(quit chan bool) {
+	ch := make(chan *IrcMessage, internalBuffer)
+	sub, _ := n.Listen.RegListener([]string{"*"}, ch, Named("batcher"))
+	defer sub.Close()
+	for {
+		select {
+		case msg := <-ch:
+			if msg == nil {
+				continue
+			}
+			n.batches.add(msg)
+		case <-quit:
+			return
+		}
+	}
+	return
+}
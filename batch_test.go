@@ -0,0 +1,71 @@
+package ircchans
+
+import (
+	"testing"
+)
+
+func TestMessageTags(t *testing.T) {
+	msg, err := PackMsg("@label=ic1;time=2011-01-01T00:00:00Z;+draft/x=a\\sb\\:c\\\\;bot :nick!u@h PRIVMSG #chan :hi there")
+	if err != nil {
+		t.Fatalf("Couldn't pack message: %s", err.String())
+	}
+	if msg.Prefix != "nick!u@h" || msg.Cmd != "PRIVMSG" || len(msg.Params) != 2 {
+		t.Errorf("Tags broke the message: %#v", msg)
+	}
+	if msg.Tags["label"] != "ic1" || msg.Tags["+draft/x"] != "a b;c\\" {
+		t.Errorf("Bad tag values: %#v", msg.Tags)
+	}
+	if _, ok := msg.Tags["bot"]; !ok {
+		t.Errorf("Tag without value missing: %#v", msg.Tags)
+	}
+	if s := msg.String(); s != "@+draft/x=a\\sb\\:c\\\\;bot;label=ic1;time=2011-01-01T00:00:00Z :nick!u@h PRIVMSG #chan :hi there" {
+		t.Errorf("Bad serialization: %s", s)
+	}
+}
+
+func TestBatches(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	b := n.batches
+	ch := make(chan *Batch, 1)
+	sub, err := n.RegBatchListener(ch)
+	if err != nil {
+		t.Fatalf("Register error: %s", err.String())
+	}
+	defer sub.Close()
+	lines := []string{
+		"BATCH +outer netsplit irc.a irc.b",
+		"@batch=outer QUIT :irc.a irc.b",
+		"@batch=outer BATCH +inner netjoin irc.a irc.b",
+		"@batch=inner JOIN #chan",
+		"BATCH -inner",
+		"BATCH -outer",
+	}
+	for _, l := range lines {
+		msg, _ := PackMsg(l)
+		b.add(&msg)
+	}
+	batch := <-ch
+	if batch.Type != "netsplit" || len(batch.Messages) != 1 || len(batch.Batches) != 1 {
+		t.Fatalf("Bad outer batch: %#v", batch)
+	}
+	if inner := batch.Batches[0]; inner.Type != "netjoin" || len(inner.Messages) != 1 || inner.Messages[0].Cmd != "JOIN" {
+		t.Errorf("Bad nested batch: %#v", inner)
+	}
+	label, out := b.expect()
+	for _, l := range []string{"@label=" + label + " BATCH +r labeled-response", "@batch=r 311 me bob u h * :Bob", "BATCH -r"} {
+		msg, _ := PackMsg(l)
+		b.add(&msg)
+	}
+	if r := <-out; r.Label != label || r.Batch == nil || len(r.Batch.Messages) != 1 {
+		t.Errorf("Bad labelled response: %#v", r)
+	}
+	if len(ch) != 0 {
+		t.Errorf("Labelled batch given to the listeners")
+	}
+	label, out = b.expect()
+	msg, _ := PackMsg("@label=" + label + " :server ACK")
+	b.add(&msg)
+	if r := <-out; len(r.Messages) != 1 || r.Messages[0].Cmd != "ACK" {
+		t.Errorf("Bad ACK response: %#v", r)
+	}
+}
@@ -0,0 +1,293 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//capSet tracks the ircv3 capabilities of a connection
+type capSet struct {
+	lock      *sync.Mutex
+	requested map[string]bool   //wanted by us, negotiated whenever the server offers them
+	available map[string]string //advertised by the server, with their values
+	enabled   map[string]bool   //acknowledged by the server
+}
+
+func newCapSet() *capSet {
+	c := &capSet{new(sync.Mutex), make(map[string]bool), make(map[string]string), make(map[string]bool)}
+	c.requested["cap-notify"] = true
+	c.requested["batch"] = true
+	c.requested["labeled-response"] = true
+	return c
+}
+
+//reset forgets what the server offered, requested capabilities are kept
+func (c *capSet) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.available = make(map[string]string)
+	c.enabled = make(map[string]bool)
+}
+
+//apply updates the set from a CAP subcommand (LS, NEW, DEL or ACK) and its list
+//of capabilities
+func (c *capSet) apply(sub, list string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, item := range strings.Fields(list) {
+		name, value := item, ""
+		if i := strings.Index(item, "="); i > -1 {
+			name, value = item[:i], item[i+1:]
+		}
+		switch sub {
+		case "LS", "NEW":
+			c.available[name] = value
+		case "DEL":
+			c.available[name] = "", false
+			c.enabled[name] = false, false
+		case "ACK":
+			if strings.HasPrefix(name, "-") {
+				c.enabled[name[1:]] = false, false
+			} else {
+				c.enabled[name] = true
+			}
+		}
+	}
+}
+
+//wanted returns the requested capabilities the server offers but which
+//aren't enabled yet
+func (c *capSet) wanted() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ret := make([]string, 0)
+	for name, _ := range c.requested {
+		if _, ok := c.available[name]; ok && !c.enabled[name] {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+func (c *capSet) value(name string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, ok := c.available[name]
+	return v, ok
+}
+
+//RequestCaps asks for ircv3 capabilities. They are negotiated during
+//registration, or right away if we're connected and the server offers them,
+//and whenever the server announces them later on.
+func (n *Network) RequestCaps(caps ...string) os.Error {
+	n.caps.lock.Lock()
+	for _, c := range caps {
+		n.caps.requested[c] = true
+	}
+	n.caps.lock.Unlock()
+	if n.Disconnected {
+		return nil
+	}
+	if want := n.caps.wanted(); len(want) > 0 {
+		return n.capReq(want)
+	}
+	return nil
+}
+
+//CapEnabled tells whether the server acknowledged the capability
+func (n *Network) CapEnabled(name string) bool {
+	n.caps.lock.Lock()
+	defer n.caps.lock.Unlock()
+	return n.caps.enabled[name]
+}
+
+//EnabledCaps lists the capabilities the server acknowledged
+func (n *Network) EnabledCaps() []string {
+	n.caps.lock.Lock()
+	defer n.caps.lock.Unlock()
+	ret := make([]string, 0, len(n.caps.enabled))
+	for name, _ := range n.caps.enabled {
+		ret = append(ret, name)
+	}
+	return ret
+}
+
+//AvailableCaps returns the capabilities the server offers, with their values
+func (n *Network) AvailableCaps() map[string]string {
+	n.caps.lock.Lock()
+	defer n.caps.lock.Unlock()
+	ret := make(map[string]string)
+	for name, value := range n.caps.available {
+		ret[name] = value
+	}
+	return ret
+}
+
+//negotiateCaps is the CAP phase of registration: list the capabilities of the
+//server, request the ones we want, authenticate and end the negotiation
+func (n *Network) negotiateCaps() os.Error {
+	if !n.capLs() {
+		return nil
+	}
+	if v, ok := n.caps.value("sts"); ok {
+		if err := n.sts(v); err == errStsUpgrade {
+			return err
+		} else if err != nil {
+			n.l.Printf("Couldn't apply sts policy: %s", err.String())
+		}
+	}
+	if want := n.caps.wanted(); len(want) > 0 {
+		if err := n.capReq(want); err != nil {
+			n.l.Printf("Capability negotiation: %s", err.String())
+		}
+	}
+	if err := n.authenticate(); err != nil {
+		n.l.Printf("Sasl authentication failed: %s", err.String())
+		if n.saslpolicy == SASLABORT {
+			return os.NewError(fmt.Sprintf("Sasl authentication failed: %s", err.String()))
+		}
+	}
+	n.queueOut <- &IrcMessage{"", "CAP", []string{"END"}, nil}
+	return nil
+}
+
+//capLs asks the server for its capabilities. It returns false if the server
+//doesn't know the CAP command.
+func (n *Network) capLs() bool {
+	q := n.newQuery([]string{"CAP", "ERR_UNKNOWNCOMMAND"}, nil, nil, true)
+	q.match = func(msg *IrcMessage) bool {
+		if msg.Cmd == "CAP" {
+			return len(msg.Params) > 1 && msg.Params[1] == "LS"
+		}
+		return len(msg.Params) > 1 && msg.Params[1] == "CAP"
+	}
+	if err := n.send(&IrcMessage{"", "CAP", []string{"LS", "302"}, nil}, q); err != nil {
+		return false
+	}
+	defer n.finish(q)
+	ticker := time.NewTicker(n.timeout())
+	defer ticker.Stop()
+	listed := false
+	for {
+		select {
+		case msg := <-q.out:
+			if msg.Cmd != "CAP" {
+				return false
+			}
+			if len(msg.Params) < 3 || msg.Params[1] != "LS" {
+				continue
+			}
+			listed = true
+			n.caps.apply("LS", msg.Params[len(msg.Params)-1])
+			if len(msg.Params) < 4 || msg.Params[2] != "*" { //no more lines follow
+				return true
+			}
+		case <-ticker.C:
+			return listed
+		}
+	}
+	return listed
+}
+
+//capReq requests capabilities, as many per line as fit, and waits for the
+//server to acknowledge or reject each line
+func (n *Network) capReq(caps []string) os.Error {
+	lines := make([]string, 0)
+	line := ""
+	for _, c := range caps {
+		if line != "" && len(line)+len(c)+1 > 400 {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += c
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	var err os.Error
+	for _, l := range lines {
+		if lerr := n.capReqLine(l); lerr != nil {
+			err = lerr
+		}
+	}
+	return err
+}
+
+//sameCaps tells whether two capability lists hold the same ones, in any order
+func sameCaps(a, b string) bool {
+	x, y := strings.Fields(a), strings.Fields(b)
+	if len(x) != len(y) {
+		return false
+	}
+	sort.Strings(x)
+	sort.Strings(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *Network) capReqLine(list string) os.Error {
+	q := n.newQuery([]string{"CAP"}, nil, nil, true)
+	q.match = func(msg *IrcMessage) bool { //the reply repeats the whole list
+		return len(msg.Params) > 2 && (msg.Params[1] == "ACK" || msg.Params[1] == "NAK") && sameCaps(msg.Params[2], list)
+	}
+	if err := n.send(&IrcMessage{"", "CAP", []string{"REQ", list}, nil}, q); err != nil {
+		return os.NewError(fmt.Sprintf("Couldn't request capabilities: %s", err.String()))
+	}
+	defer n.finish(q)
+	ticker := time.NewTicker(n.timeout())
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-q.out:
+			switch msg.Params[1] {
+			case "ACK":
+				n.caps.apply("ACK", msg.Params[2])
+				return nil
+			case "NAK":
+				return os.NewError(fmt.Sprintf("Capabilities rejected: %s", msg.Params[2]))
+			}
+		case <-ticker.C:
+			return os.NewError(fmt.Sprintf("No reply to capability request: %s", list))
+		}
+	}
+	return nil
+}
+
+//capper keeps the capabilities up to date when the server announces new ones
+//or withdraws some (cap-notify), and requests the new ones we want
+func (n *Network) capper(quit chan bool) {
+	ch := make(chan *IrcMessage, internalBuffer)
+	sub, _ := n.Listen.RegListener([]string{"CAP"}, ch)
+	defer sub.Close()
+	for {
+		select {
+		case msg := <-ch:
+			if msg == nil || len(msg.Params) < 3 {
+				continue
+			}
+			switch sub := msg.Params[1]; sub {
+			case "NEW":
+				n.caps.apply(sub, msg.Params[len(msg.Params)-1])
+				if want := n.caps.wanted(); len(want) > 0 {
+					go n.capReq(want)
+				}
+			case "DEL", "ACK":
+				n.caps.apply(sub, msg.Params[len(msg.Params)-1])
+			}
+		case <-quit:
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,27 @@
+package ircchans
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCapReqMatch(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	n.lags.add(1)
+	errch := make(chan os.Error, 1)
+	go func() {
+		errch <- n.capReqLine("sasl batch")
+	}()
+	if msg := <-n.queueOut; msg.Cmd != "CAP" || msg.Params[1] != "sasl batch" {
+		t.Fatalf("Bad request: %s", msg.String())
+	}
+	isupport := n.isupport.get()
+	n.correlator.route(&IrcMessage{"server", "CAP", []string{"me", "NAK", "away-notify"}, nil}, isupport)
+	n.correlator.route(&IrcMessage{"server", "CAP", []string{"me", "ACK", "batch sasl "}, nil}, isupport)
+	if err := <-errch; err != nil {
+		t.Errorf("Got the reply to another request: %s", err.String())
+	}
+	if !n.CapEnabled("sasl") || !n.CapEnabled("batch") || n.CapEnabled("away-notify") {
+		t.Errorf("Bad capabilities enabled: %v", n.EnabledCaps())
+	}
+}
@@ -0,0 +1,301 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//query is a command waiting for its replies. Replies are matched to the oldest
+//pending query expecting their command and target; a query that can't share
+//its replies with another (exclusive) waits for the ones it could be confused
+//with to finish before being sent, and the others wait for it. When
+//labeled-response is enabled queries are labelled instead, and only given the
+//replies carrying their label.
+type query struct {
+	codes     map[string]bool //commands and numerics of the replies
+	end       map[string]bool //replies ending the query
+	targets   map[string]bool //folded nicks or channels the replies are about, any if empty
+	match     func(msg *IrcMessage) bool
+	exclusive bool
+	out       chan *IrcMessage
+	done      chan bool //closed once no more replies are routed to it
+	finished  bool
+	gone      chan bool //closed once the caller stopped reading out
+	left      bool
+	label     string //set when sent with a label
+}
+
+//errors telling about the command rather than a target, like
+//ERR_NEEDMOREPARAMS whose second parameter is the command
+var untargeted = map[string]bool{}
+
+func init() {
+	for _, code := range replyCodes("ERR_NORECIPIENT", "ERR_NOTEXTTOSEND", "ERR_NEEDMOREPARAMS", "ERR_UNKNOWNCOMMAND",
+		"ERR_NOTREGISTERED", "ERR_ALREADYREGISTRED", "ERR_NONICKNAMEGIVEN", "ERR_PASSWDMISMATCH", "ERR_NOORIGIN") {
+		untargeted[code] = true
+	}
+}
+
+//newQuery prepares a query for the replies named in myreplies (see replyCodes),
+//the ones in end finish it
+func (n *Network) newQuery(myreplies, end, targets []string, exclusive bool) *query {
+	q := &query{make(map[string]bool), make(map[string]bool), make(map[string]bool), nil, exclusive, make(chan *IrcMessage, 50), make(chan bool), false, make(chan bool), false, ""}
+	for _, code := range replyCodes(myreplies...) {
+		q.codes[code] = true
+	}
+	for _, code := range replyCodes(end...) {
+		q.codes[code] = true
+		q.end[code] = true
+	}
+	isupport := n.isupport.get()
+	for _, t := range targets {
+		q.targets[isupport.Fold(t)] = true
+	}
+	return q
+}
+
+//conflicts tells whether two queries could be given each other's replies
+func (q *query) conflicts(o *query) bool {
+	shared := false
+	for code, _ := range q.codes {
+		if o.codes[code] {
+			shared = true
+			break
+		}
+	}
+	if !shared {
+		return false
+	}
+	if len(q.targets) == 0 || len(o.targets) == 0 {
+		return true
+	}
+	for t, _ := range q.targets {
+		if o.targets[t] {
+			return true
+		}
+	}
+	return false
+}
+
+type correlator struct {
+	lock    *sync.Mutex
+	sending *sync.Mutex       //taken before lock, keeps the queries in sending order
+	pending []*query          //in the order they were sent
+	batches map[string]string //labels of the open labelled batches, by reference
+}
+
+func newCorrelator() *correlator {
+	return &correlator{new(sync.Mutex), new(sync.Mutex), make([]*query, 0), make(map[string]string)}
+}
+
+//finish removes a query, the caller must hold the lock
+func (c *correlator) finish(q *query) {
+	if q.finished {
+		return
+	}
+	q.finished = true
+	close(q.done)
+	for i, p := range c.pending {
+		if p == q {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			break
+		}
+	}
+}
+
+func (c *correlator) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.pending) > 0 {
+		c.finish(c.pending[0])
+	}
+	c.batches = make(map[string]string)
+}
+
+//label returns the label of the command msg answers, if any, and whether it
+//is the last message of the response. The caller must hold the lock.
+func (c *correlator) label(msg *IrcMessage) (string, bool) {
+	label, tagged := msg.Tags["label"]
+	if !tagged {
+		label = c.batches[msg.Tags["batch"]]
+	}
+	if msg.Cmd == "BATCH" && len(msg.Params) > 0 && len(msg.Params[0]) > 1 {
+		ref := msg.Params[0][1:]
+		switch msg.Params[0][0] {
+		case '+':
+			if label != "" {
+				c.batches[ref] = label
+			}
+			return label, false
+		case '-':
+			label = c.batches[ref]
+			c.batches[ref] = "", false
+			for _, l := range c.batches {
+				if l == label { //a nested batch is still open
+					return label, false
+				}
+			}
+			return label, true
+		}
+	}
+	return label, tagged //a lone labelled reply or ACK
+}
+
+//route gives a labelled msg to the query with its label, and other replies to
+//the oldest unlabelled query they answer. Queries that could be given each
+//other's replies are never pending together unless neither is exclusive.
+//It waits for the query to read the reply, or to give up.
+func (c *correlator) route(msg *IrcMessage, isupport *ISupport) {
+	target := ""
+	if untargeted[msg.Cmd] {
+		//about the command, any query expecting it will do
+	} else if isNumeric(msg.Cmd) && len(msg.Params) > 1 {
+		target = msg.Params[1] //after our nick
+	} else if !isNumeric(msg.Cmd) && len(msg.Params) > 0 {
+		target = msg.Params[0]
+	}
+	c.lock.Lock()
+	var best *query
+	if label, last := c.label(msg); label != "" {
+		for _, q := range c.pending {
+			if q.label == label {
+				if last {
+					c.finish(q)
+				}
+				if q.codes[msg.Cmd] && (q.match == nil || q.match(msg)) {
+					best = q
+				}
+				break
+			}
+		}
+	} else {
+		for _, q := range c.pending {
+			if q.label != "" || !q.codes[msg.Cmd] || (q.match != nil && !q.match(msg)) {
+				continue
+			}
+			if len(q.targets) > 0 && target != "" && !q.wants(target, isupport) {
+				continue
+			}
+			best = q
+			break
+		}
+	}
+	if best != nil && best.end[msg.Cmd] {
+		c.finish(best)
+	}
+	c.lock.Unlock()
+	if best == nil {
+		return
+	}
+	select {
+	case best.out <- msg:
+	case <-best.gone:
+	}
+}
+
+//wants tells whether target, possibly a list, is one of the query's
+func (q *query) wants(target string, isupport *ISupport) bool {
+	for _, t := range strings.Split(target, ",", -1) {
+		if q.targets[isupport.Fold(t)] {
+			return true
+		}
+	}
+	return false
+}
+
+func isNumeric(cmd string) bool {
+	if len(cmd) != 3 {
+		return false
+	}
+	for _, c := range cmd {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+//send queues msg and the query waiting for its replies. A query first waits
+//for the pending ones it conflicts with when either is exclusive, unless
+//labeled-response is enabled: msg is then labelled and can't be confused with
+//any other. The query is finished if msg couldn't be queued or an interceptor
+//dropped it.
+func (n *Network) send(msg *IrcMessage, q *query) os.Error {
+	if q.label == "" && n.CapEnabled("labeled-response") {
+		q.label = n.batches.newLabel()
+		msg = msg.withTag("label", q.label)
+	}
+	ticker := time.NewTicker(n.timeout())
+	defer ticker.Stop()
+	for {
+		var busy *query
+		n.correlator.sending.Lock()
+		n.correlator.lock.Lock()
+		for _, p := range n.correlator.pending {
+			if q.label == "" && p.label == "" && (q.exclusive || p.exclusive) && q.conflicts(p) {
+				busy = p
+				break
+			}
+		}
+		if busy == nil {
+			n.correlator.pending = append(n.correlator.pending, q)
+			n.correlator.lock.Unlock() //replies are routed while we queue
+			out, verdict := n.interceptors.expect(msg)
+			select {
+			case n.queueOut <- out:
+			case <-ticker.C:
+				n.correlator.sending.Unlock()
+				n.interceptors.verdict(out, nil) //not waiting for it anymore
+				n.finish(q)
+				return os.NewError(fmt.Sprintf("Timeout queueing %s", msg.Cmd))
+			}
+			n.correlator.sending.Unlock()
+			if err := n.interceptors.wait(out, verdict, n.timeout()); err != nil {
+				n.finish(q)
+				return err
+			}
+			return nil
+		}
+		n.correlator.lock.Unlock()
+		n.correlator.sending.Unlock()
+		select {
+		case <-busy.done:
+		case <-ticker.C:
+			return os.NewError(fmt.Sprintf("Timeout waiting to send %s", msg.Cmd))
+		}
+	}
+	return nil
+}
+
+//finish stops routing replies to q, the caller doesn't read them anymore
+func (n *Network) finish(q *query) {
+	n.correlator.lock.Lock()
+	defer n.correlator.lock.Unlock()
+	n.correlator.finish(q)
+	if !q.left {
+		q.left = true
+		close(q.gone)
+	}
+}
+
+//correlate routes the replies of the server to the queries waiting for them
+func (n *Network) correlate(quit chan bool) {
+	ch := make(chan *IrcMessage, internalBuffer)
+	sub, _ := n.Listen.RegListener([]string{"*"}, ch, Named("correlator"))
+	defer sub.Close()
+	for {
+		select {
+		case msg := <-ch:
+			if msg == nil {
+				continue
+			}
+			n.correlator.route(msg, n.isupport.get())
+		case <-quit:
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,109 @@
+package ircchans
+
+import (
+	"testing"
+)
+
+func TestCorrelator(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	privmsg := n.newQuery([]string{"ERR_NOSUCHNICK"}, nil, []string{"alice"}, false)
+	whois := n.newQuery([]string{"ERR_NOSUCHNICK", "RPL_WHOISUSER"}, []string{"RPL_ENDOFWHOIS"}, []string{"Bob"}, true)
+	n.send(&IrcMessage{"", "PRIVMSG", []string{"alice", "hi"}, nil}, privmsg)
+	n.send(&IrcMessage{"", "WHOIS", []string{"Bob"}, nil}, whois)
+	isupport := n.isupport.get()
+	n.correlator.route(&IrcMessage{"server", "401", []string{"me", "bob", "No such nick"}, nil}, isupport)
+	n.correlator.route(&IrcMessage{"server", "401", []string{"me", "alice", "No such nick"}, nil}, isupport)
+	n.correlator.route(&IrcMessage{"server", "318", []string{"me", "bob", "End of WHOIS"}, nil}, isupport)
+	if m := <-privmsg.out; m.Params[1] != "alice" {
+		t.Errorf("Privmsg got the reply about %s", m.Params[1])
+	}
+	if m := <-whois.out; m.Params[1] != "bob" {
+		t.Errorf("Whois got the reply about %s", m.Params[1])
+	}
+	if m := <-whois.out; m.Cmd != "318" {
+		t.Errorf("Whois got %s, expected the end of whois", m.Cmd)
+	}
+	if !whois.finished || len(n.correlator.pending) != 1 {
+		t.Errorf("End of whois didn't finish the query")
+	}
+	n.finish(privmsg)
+	if len(n.correlator.pending) != 0 {
+		t.Errorf("Queries still pending: %d", len(n.correlator.pending))
+	}
+}
+
+func TestCorrelatorOverlap(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	privmsg := n.newQuery([]string{"ERR_NOSUCHNICK", "ERR_NOTEXTTOSEND"}, nil, []string{"alice"}, false)
+	n.send(&IrcMessage{"", "PRIVMSG", []string{"alice", "hi"}, nil}, privmsg)
+	whois := n.newQuery([]string{"ERR_NOSUCHNICK"}, []string{"RPL_ENDOFWHOIS"}, []string{"Alice"}, true)
+	sent := make(chan bool)
+	go func() {
+		n.send(&IrcMessage{"", "WHOIS", []string{"Alice"}, nil}, whois)
+		close(sent)
+	}()
+	isupport := n.isupport.get()
+	n.correlator.route(&IrcMessage{"server", "401", []string{"me", "alice", "No such nick"}, nil}, isupport)
+	n.correlator.route(&IrcMessage{"server", "412", []string{"me", "No text to send"}, nil}, isupport)
+	if m := <-privmsg.out; m.Cmd != "401" {
+		t.Errorf("Privmsg got %s, expected its 401", m.Cmd)
+	}
+	if m := <-privmsg.out; m.Cmd != "412" {
+		t.Errorf("Privmsg got %s, expected the untargeted 412", m.Cmd)
+	}
+	n.correlator.lock.Lock()
+	pending := len(n.correlator.pending)
+	n.correlator.lock.Unlock()
+	if pending != 1 {
+		t.Errorf("Whois sent while a privmsg to the same nick was pending")
+	}
+	n.finish(privmsg)
+	<-sent
+	n.correlator.route(&IrcMessage{"server", "401", []string{"me", "alice", "No such nick"}, nil}, isupport)
+	if m := <-whois.out; m.Cmd != "401" {
+		t.Errorf("Whois got %s, expected its 401", m.Cmd)
+	}
+	n.finish(whois)
+}
+
+func TestCorrelatorLabels(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	n.lags.add(1)
+	n.caps.apply("ACK", "labeled-response")
+	first := n.newQuery([]string{"RPL_WHOISUSER"}, []string{"RPL_ENDOFWHOIS"}, []string{"bob"}, true)
+	second := n.newQuery([]string{"RPL_WHOISUSER"}, []string{"RPL_ENDOFWHOIS"}, []string{"bob"}, true)
+	for _, q := range []*query{first, second} {
+		if err := n.send(&IrcMessage{"", "WHOIS", []string{"bob"}, nil}, q); err != nil {
+			t.Fatalf("Labelled whois waited for the other: %s", err.String())
+		}
+		if sent := <-n.queueOut; sent.Tags["label"] == "" || sent.Tags["label"] != q.label {
+			t.Errorf("Whois sent without its label: %s", sent.String())
+		}
+	}
+	if first.label == second.label {
+		t.Fatalf("Both queries labelled %s", first.label)
+	}
+	isupport := n.isupport.get()
+	for _, l := range []string{"@label=" + second.label + " BATCH +r labeled-response", "@batch=r :server 311 me bob u h * :Bob",
+		"@batch=r :server 318 me bob :End of WHOIS", "BATCH -r", ":server 311 me bob u h * :Bob"} {
+		msg, _ := PackMsg(l)
+		n.correlator.route(&msg, isupport)
+	}
+	if m := <-second.out; m.Cmd != "311" {
+		t.Errorf("Labelled whois got %s, expected its 311", m.Cmd)
+	}
+	if m := <-second.out; m.Cmd != "318" {
+		t.Errorf("Labelled whois got %s, expected its 318", m.Cmd)
+	}
+	if !second.finished {
+		t.Errorf("End of the labelled batch didn't finish the query")
+	}
+	if len(first.out) != 0 {
+		t.Errorf("Replies given to a query with another label")
+	}
+	msg, _ := PackMsg("@label=" + first.label + " :server ACK")
+	n.correlator.route(&msg, isupport)
+	if !first.finished || len(first.out) != 0 || len(n.correlator.pending) != 0 {
+		t.Errorf("ACK didn't finish the labelled query")
+	}
+}
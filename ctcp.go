@@ -7,23 +7,18 @@ import (
 )
 
 //CTCP sucks, each client implements it a bit differently
-func (n *Network) ctcp() {
-	exch := make(chan bool, 0)
-	err := n.Shutdown.Reg(exch)
-	if err != nil {
-		return
-	}
-	ch := make(chan *IrcMessage)
-	n.Listen.RegListener("PRIVMSG", "ctcp", ch)
-	defer n.Listen.DelListener("PRIVMSG", "ctcp")
+func (n *Network) ctcp(quit chan bool) {
+	ch := make(chan *IrcMessage, internalBuffer)
+	sub, _ := n.Listen.RegListener([]string{"PRIVMSG"}, ch)
+	defer sub.Close()
 	for !closed(ch) {
 		var p *IrcMessage
 		select {
 		case p = <-ch:
-		case exit := <-exch:
-			if exit {
-				return
-			}
+		case <-quit:
+			return
+		}
+		if p == nil || len(p.Params) < 2 || p.Params[1] == "" {
 			continue
 		}
 		if i := strings.LastIndex(p.Params[1], "\x01"); i > -1 { //FIXME: DCC?
@@ -37,7 +32,7 @@ func (n *Network) ctcp() {
 				n.Notice(dst, fmt.Sprintf("\x01USERINFO %s\x01", n.user))
 			case ctype == "CLIENTINFO":
 				n.Notice(dst, "\x01CLIENTINFO PING VERSION TIME USERINFO CLIENTINFO FINGER SOURCE\x01")
-			case ctype[0:4] == "PING":
+			case strings.HasPrefix(ctype, "PING"):
 				params := strings.Split(p.Params[1], " ", -1)
 				if len(params) < 2 {
 					n.l.Println("Illegal ctcp ping received: No arguments", p)
@@ -0,0 +1,201 @@
+package ircchans
+
+import (
+	"os"
+	"net"
+	"fmt"
+	"strings"
+	"time"
+	"crypto/tls"
+)
+
+//address family preferences for SetIPPreference
+const (
+	PREFERIPV6 = iota //try ipv6 first, race ipv4 (the default)
+	PREFERIPV4        //try ipv4 first, race ipv6
+	IPV6ONLY
+	IPV4ONLY
+)
+
+//delay before racing the next address while the previous attempt is pending
+const raceDelay = second / 4
+
+type dialResult struct {
+	conn net.Conn
+	err  os.Error
+}
+
+//SetBindAddress sets the local ip address used for outgoing connections. Only
+//remote addresses of the same family are tried. It takes effect on the next
+//Connect, and isn't used by websocket transports.
+func (n *Network) SetBindAddress(addr string) os.Error {
+	if addr != "" && net.ParseIP(addr) == nil {
+		return os.NewError(fmt.Sprintf("Bad bind address: %s", addr))
+	}
+	n.bindaddr = addr
+	return nil
+}
+
+//SetIPPreference chooses which address family is tried first when the server
+//resolves to both, or restricts connections to one family.
+func (n *Network) SetIPPreference(pref int) {
+	n.ippref = pref
+}
+
+//GetServer returns the address of the server we're connected to
+func (n *Network) GetServer() string {
+	return n.server
+}
+
+//GetLocalAddr returns the local address of the current connection
+func (n *Network) GetLocalAddr() string {
+	return n.localaddr
+}
+
+func isIPv4(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() != nil
+}
+
+//joinHostPort is like strings.Join with ":" but brackets ipv6 addresses
+func joinHostPort(host, port string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		host = "[" + host + "]"
+	}
+	return strings.Join([]string{host, port}, ":")
+}
+
+//resolve looks up host and orders its addresses for racing
+func (n *Network) resolve(host string) ([]string, os.Error) {
+	host = strings.Trim(host, "[]")
+	var addrs []string
+	if net.ParseIP(host) != nil {
+		addrs = []string{host}
+	} else {
+		var err os.Error
+		addrs, err = net.LookupHost(host)
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("Couldn't resolve %s: %s", host, err.String()))
+		}
+	}
+	ret := n.order(addrs)
+	if len(ret) == 0 {
+		return nil, os.NewError(fmt.Sprintf("No usable address for %s", host))
+	}
+	return ret, nil
+}
+
+//order keeps the addresses we may use, the preferred family first, then
+//alternating families
+func (n *Network) order(addrs []string) []string {
+	v4, v6 := make([]string, 0), make([]string, 0)
+	for _, a := range addrs {
+		if n.bindaddr != "" && isIPv4(a) != isIPv4(n.bindaddr) {
+			continue
+		}
+		if isIPv4(a) {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	first, other := v6, v4
+	switch n.ippref {
+	case PREFERIPV4:
+		first, other = v4, v6
+	case IPV6ONLY:
+		other = []string{}
+	case IPV4ONLY:
+		first, other = v4, []string{}
+	}
+	ret := make([]string, 0, len(first)+len(other))
+	for i := 0; i < len(first) || i < len(other); i++ {
+		if i < len(first) {
+			ret = append(ret, first[i])
+		}
+		if i < len(other) {
+			ret = append(ret, other[i])
+		}
+	}
+	return ret
+}
+
+//dialTCP connects to host, racing its addresses Happy Eyeballs style
+func (n *Network) dialTCP(host, port string) (net.Conn, os.Error) {
+	addrs, err := n.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	laddr := ""
+	if n.bindaddr != "" {
+		laddr = joinHostPort(n.bindaddr, "0")
+	}
+	return race(addrs, func(addr string) (net.Conn, os.Error) {
+		return net.Dial("tcp", laddr, joinHostPort(addr, port))
+	})
+}
+
+//race calls dial on the addresses in order, starting the next attempt every
+//raceDelay or as soon as the previous one failed, and returns the first
+//connection established. The others are closed.
+func race(addrs []string, dial func(addr string) (net.Conn, os.Error)) (net.Conn, os.Error) {
+	var err os.Error
+	results := make(chan dialResult, len(addrs)) //buffered so losers never block
+	next, pending := 0, 0
+	start := func() {
+		go func(addr string) {
+			conn, err := dial(addr)
+			results <- dialResult{conn, err}
+		}(addrs[next])
+		next++
+		pending++
+	}
+	ticker := time.NewTicker(raceDelay)
+	defer ticker.Stop()
+	start()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(pending int) { //close the connections that lost the race
+					for ; pending > 0; pending-- {
+						if r := <-results; r.err == nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			err = r.err
+			if next < len(addrs) {
+				start()
+			}
+		case <-ticker.C:
+			if next < len(addrs) {
+				start()
+			}
+		}
+	}
+	return nil, err
+}
+
+//dialTLS connects to host like dialTCP and performs the tls handshake
+func (n *Network) dialTLS(host, port string) (net.Conn, os.Error) {
+	tlsConfig, err := CustomTlsConf()
+	if err != nil {
+		return nil, err
+	}
+	conf := *tlsConfig
+	conf.ServerName = strings.Trim(host, "[]") //the certificate is checked against it
+	conn, err := n.dialTCP(host, port)
+	if err != nil {
+		return nil, err
+	}
+	tlsconn := tls.Client(conn, &conf)
+	if err := tlsconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsconn, nil
+}
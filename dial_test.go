@@ -0,0 +1,67 @@
+package ircchans
+
+import (
+	"os"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddressOrder(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	addrs := []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"}
+	orders := []struct {
+		pref     int
+		bind     string
+		expected string
+	}{
+		{PREFERIPV6, "", "2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2"},
+		{PREFERIPV4, "", "192.0.2.1 2001:db8::1 192.0.2.2 2001:db8::2"},
+		{IPV6ONLY, "", "2001:db8::1 2001:db8::2"},
+		{IPV4ONLY, "", "192.0.2.1 192.0.2.2"},
+		{PREFERIPV6, "127.0.0.1", "192.0.2.1 192.0.2.2"},
+	}
+	for _, o := range orders {
+		n.SetIPPreference(o.pref)
+		n.SetBindAddress(o.bind)
+		if got := strings.Join(n.order(addrs), " "); got != o.expected {
+			t.Errorf("Preference %d, bound to %q: got %s, expected %s", o.pref, o.bind, got, o.expected)
+		}
+	}
+}
+
+func TestRace(t *testing.T) {
+	peers := make(map[string]net.Conn)
+	conns := make(map[string]net.Conn)
+	for _, addr := range []string{"slow", "fast"} {
+		conns[addr], peers[addr] = net.Pipe()
+	}
+	dial := func(addr string) (net.Conn, os.Error) {
+		switch addr {
+		case "slow":
+			time.Sleep(second)
+		case "bad":
+			return nil, os.NewError("refused")
+		}
+		return conns[addr], nil
+	}
+	start := time.Nanoseconds()
+	conn, err := race([]string{"slow", "fast"}, dial)
+	if err != nil || conn != conns["fast"] {
+		t.Fatalf("The fast address didn't win the race: %v", err)
+	}
+	if time.Nanoseconds()-start >= second {
+		t.Errorf("Waited for the slow address")
+	}
+	if _, err := peers["slow"].Read(make([]byte, 1)); err == nil { //returns once closed
+		t.Errorf("Losing connection not closed")
+	}
+	conn, err = race([]string{"bad", "fast"}, dial)
+	if err != nil || conn != conns["fast"] {
+		t.Errorf("Next address not tried after a failure: %v", err)
+	}
+	if _, err := race([]string{"bad", "bad"}, dial); err == nil {
+		t.Errorf("No error when every address failed")
+	}
+}
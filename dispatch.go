@@ -2,84 +2,539 @@ package ircchans
 
 import (
 	"os"
+	"io"
 	"fmt"
+	"log"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
+//deliveryQueue is how many messages wait for the delivery goroutine of a
+//listener, while it's blocked on the channel or in the handler
+const deliveryQueue = 256
+
+//internalBuffer is the channel size of the listeners the library keeps its
+//state with, large enough that they don't miss messages nor need to block
+const internalBuffer = 1024
+
+//what happens to a message when the channel of a listener is full, or the
+//queue of a handler
+const (
+	DROPNEWEST = iota //drop the message (the default)
+	DROPOLDEST        //drop the oldest message in the channel to make room
+	BLOCK             //wait for room up to the timeout, then drop the message
+	DISCONNECT        //unregister the listener and close its channel
+)
+
+//ListenerOption configures a listener when registering it
+type ListenerOption func(*delivery)
+
+//Overflow sets what to do when the listener can't keep up. The timeout, in
+//nanoseconds, is only used by BLOCK and must be positive. Blocking holds the
+//next messages of the listener back, and stalls every other listener once
+//deliveryQueue of them are waiting.
+func Overflow(policy int, timeout int64) ListenerOption {
+	return func(d *delivery) {
+		d.policy = policy
+		d.timeout = timeout
+	}
+}
+
+//Named gives the listener a name shown by Subscriptions and Dump
+func Named(name string) ListenerOption {
+	return func(d *delivery) {
+		d.name = name
+	}
+}
+
+//ListenerStats counts the messages of a listener channel, whatever commands
+//it's registered for
+type ListenerStats struct {
+	Delivered int64 //written to the channel
+	Dropped   int64 //lost because the listener was too slow
+	Queued    int   //waiting to be written
+}
+
+//delivery feeds a listener channel from its queue, in the order the messages
+//were dispatched. Subscriptions sharing a channel share its delivery.
+type delivery struct {
+	queue     chan *IrcMessage
+	name      string
+	refs      int       //subscriptions using the channel
+	quit      chan bool //closed when the last subscription is closed
+	done      chan bool //closed once the delivery goroutine exited
+	policy    int
+	timeout   int64
+	filter    Filter
+	handler   HandlerFunc //called instead of writing to the channel
+	lock      *sync.Mutex //protects the counters
+	l         *log.Logger
+	delivered int64
+	dropped   int64
+}
+
+func newDelivery(l *log.Logger) *delivery {
+	return &delivery{queue: make(chan *IrcMessage, deliveryQueue), quit: make(chan bool), done: make(chan bool), lock: new(sync.Mutex), l: l}
+}
+
+//run writes the queued messages to ch, or calls the handler with them. slow is
+//called when the listener has to be disconnected.
+func (d *delivery) run(ch chan *IrcMessage, slow func()) {
+	defer close(d.done)
+	for {
+		select {
+		case msg := <-d.queue:
+			select {
+			case <-d.quit: //closed while we were busy
+				return
+			default:
+			}
+			if d.handler != nil {
+				d.handler(msg)
+				d.count(1, 0)
+				continue
+			}
+			if !d.send(ch, msg) {
+				go slow()
+				return
+			}
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+//send writes msg to ch according to the overflow policy. It returns false if
+//the listener has to be disconnected.
+func (d *delivery) send(ch chan *IrcMessage, msg *IrcMessage) bool {
+	if ok := ch <- msg; ok {
+		d.count(1, 0)
+		return true
+	}
+	switch d.policy {
+	case DROPOLDEST:
+		if _, ok := <-ch; ok {
+			d.count(0, 1)
+		}
+		if ok := ch <- msg; ok {
+			d.count(1, 0)
+		} else {
+			d.count(0, 1)
+		}
+	case BLOCK:
+		ticker := time.NewTicker(d.timeout)
+		defer ticker.Stop()
+		select {
+		case ch <- msg:
+			d.count(1, 0)
+		case <-ticker.C:
+			d.count(0, 1)
+		case <-d.quit:
+		}
+	case DISCONNECT:
+		d.count(0, 1)
+		return false
+	default:
+		d.count(0, 1)
+	}
+	return true
+}
+
+func (d *delivery) count(delivered, dropped int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.delivered += delivered
+	d.dropped += dropped
+}
+
+func (d *delivery) stats() ListenerStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return ListenerStats{d.delivered, d.dropped, len(d.queue)}
+}
+
+//check validates the options of a delivery
+func (d *delivery) check() os.Error {
+	if d.policy < DROPNEWEST || d.policy > DISCONNECT {
+		return os.NewError(fmt.Sprintf("Unknown overflow policy %d", d.policy))
+	}
+	if d.policy == BLOCK && d.timeout <= 0 {
+		return os.NewError(fmt.Sprintf("Bad timeout %d for BLOCK, it must be positive", d.timeout))
+	}
+	return nil
+}
+
+//stop ends the delivery and closes ch once nothing can be written to it. It
+//must be called without the map lock, the delivery may be blocked on ch. A
+//handler may be the one closing its subscription and never writes to ch, so
+//it's not waited for: a call in progress finishes on its own.
+func (d *delivery) stop(ch chan *IrcMessage) {
+	close(d.quit)
+	if d.handler == nil {
+		<-d.done
+	}
+	close(ch)
+}
+
+//accepts runs the filter, a filter that panics rejects the message instead of
+//taking the dispatcher down
+func (d *delivery) accepts(msg *IrcMessage) (ok bool) {
+	if d.filter == nil {
+		return true
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			d.l.Printf("Filter of %s panicked on %s: %v", d.name, msg, err)
+			ok = false
+		}
+	}()
+	return d.filter(msg)
+}
+
+//push queues msg for the delivery goroutine without blocking, it returns
+//false when the queue is full
+func (d *delivery) push(msg *IrcMessage) bool {
+	if !d.accepts(msg) {
+		return true
+	}
+	ok := d.queue <- msg
+	return ok
+}
+
+//overflow applies the overflow policy to msg when the queue is full. It must be
+//called without the map lock, it may block. It returns false if the listener
+//has to be disconnected.
+func (d *delivery) overflow(msg *IrcMessage) bool {
+	switch d.policy {
+	case DROPOLDEST:
+		if _, ok := <-d.queue; ok {
+			d.count(0, 1)
+		}
+		if ok := d.queue <- msg; !ok {
+			d.count(0, 1)
+		}
+	case BLOCK:
+		ticker := time.NewTicker(d.timeout)
+		defer ticker.Stop()
+		select {
+		case d.queue <- msg:
+		case <-ticker.C:
+			d.count(0, 1)
+		case <-d.quit:
+		}
+	case DISCONNECT:
+		d.count(0, 1)
+		return false
+	default:
+		d.count(0, 1)
+	}
+	return true
+}
+
+//Subscription is the registration of a listener channel for one or more
+//commands, returned by RegListener and Handle, or for updates like the lag
+//statistics (Cmds is empty then)
+type Subscription struct {
+	ID         int64 //unique in the process
+	Cmds       []string
+	Registered int64 //time.Nanoseconds() when it was registered
+	ch         chan *IrcMessage
+	m          *dispatchMap
+	notifier   *notifier //for updates
+}
+
+var (
+	subscriptionLock = new(sync.Mutex)
+	lastSubscription int64
+)
+
+func nextSubscriptionID() int64 {
+	subscriptionLock.Lock()
+	defer subscriptionLock.Unlock()
+	lastSubscription++
+	return lastSubscription
+}
+
+//Close unregisters the listener from all its commands at once. The channel is
+//closed when no other subscription uses it.
+func (s *Subscription) Close() os.Error {
+	if s.notifier != nil {
+		return s.notifier.remove(s.ID)
+	}
+	s.m.lock.Lock()
+	if _, ok := s.m.subs[s.ID]; !ok {
+		s.m.lock.Unlock()
+		return os.NewError(fmt.Sprintf("Subscription %d is already closed", s.ID))
+	}
+	s.m.remove(s)
+	d := s.m.deliveries[s.ch]
+	if d.refs--; d.refs > 0 { //still in use by other subscriptions
+		s.m.lock.Unlock()
+		return nil
+	}
+	s.m.deliveries[s.ch] = nil, false //no more messages are queued
+	s.m.lock.Unlock()
+	d.stop(s.ch)
+	return nil
+}
+
+//Stats returns the counters of the subscription's channel
+func (s *Subscription) Stats() (ListenerStats, os.Error) {
+	if s.notifier != nil {
+		return s.notifier.stats(s.ID)
+	}
+	s.m.lock.RLock()
+	defer s.m.lock.RUnlock()
+	if _, ok := s.m.subs[s.ID]; !ok {
+		return ListenerStats{}, os.NewError(fmt.Sprintf("Subscription %d is closed", s.ID))
+	}
+	return s.m.deliveries[s.ch].stats(), nil
+}
+
+//dispatchMap sends messages to the listeners registered for their command.
+//Every listener channel receives the messages in the order they were sent or
+//received on the wire, whatever commands it's registered for: a channel
+//listening to JOIN and PART never sees a PART before the JOIN preceding it.
+//A channel gets every message once, however many of its subscriptions match.
 type dispatchMap struct {
-	lock  *sync.RWMutex
-	chans map[string]map[string]chan *IrcMessage //wildcard * is for any message
+	lock       *sync.RWMutex
+	chans      map[string]map[int64]chan *IrcMessage //by command and subscription, wildcard * is for any message
+	subs       map[int64]*Subscription
+	deliveries map[chan *IrcMessage]*delivery
+	l          *log.Logger //for the errors of the listeners
+}
+
+func newDispatchMap(l *log.Logger) dispatchMap {
+	return dispatchMap{new(sync.RWMutex), make(map[string]map[int64]chan *IrcMessage), make(map[int64]*Subscription), make(map[chan *IrcMessage]*delivery), l}
 }
 
-func (m *dispatchMap) RegListener(cmd, name string, ch chan *IrcMessage) os.Error {
+//RegListener registers ch to receive the messages of the commands, "*" being
+//every command. Options given for a channel already registered by another
+//subscription replace the previous ones.
+func (m *dispatchMap) RegListener(cmds []string, ch chan *IrcMessage, opts ...ListenerOption) (*Subscription, os.Error) {
+	if len(cmds) == 0 {
+		return nil, os.NewError("Can't register listener: no command given")
+	}
+	if ch == nil {
+		return nil, os.NewError("Can't register listener: nil channel")
+	}
+	s := &Subscription{nextSubscriptionID(), cmds, time.Nanoseconds(), ch, m, nil}
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	if _, ok := m.chans[cmd]; !ok {
-		m.chans[cmd] = make(map[string]chan *IrcMessage)
-	} else if ch, ok := m.chans[cmd][name]; ok {
-		if ch != nil {
-			return os.NewError(fmt.Sprintf("Can't register listener %s for cmd %s: already listening", name, cmd))
+	d, ok := m.deliveries[ch]
+	probe := delivery{} //options are checked before touching the listener
+	if ok {
+		probe.policy, probe.timeout = d.policy, d.timeout
+	}
+	for _, opt := range opts {
+		opt(&probe)
+	}
+	if err := probe.check(); err != nil {
+		return nil, os.NewError(fmt.Sprintf("Can't register listener: %s", err.String()))
+	}
+	for _, cmd := range cmds {
+		if _, ok := m.chans[cmd]; !ok {
+			m.chans[cmd] = make(map[int64]chan *IrcMessage)
 		}
+		m.chans[cmd][s.ID] = ch
 	}
-	m.chans[cmd][name] = ch
-	return nil
+	m.subs[s.ID] = s
+	if !ok {
+		d = newDelivery(m.l)
+		m.deliveries[ch] = d
+		go d.run(ch, func() { m.disconnect(ch) })
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	d.refs++
+	return s, nil
+}
+
+//remove takes a subscription off the map, the caller must hold the lock
+func (m *dispatchMap) remove(s *Subscription) {
+	for _, cmd := range s.Cmds {
+		if m.chans[cmd] == nil {
+			continue
+		}
+		m.chans[cmd][s.ID] = nil, false
+		if len(m.chans[cmd]) == 0 {
+			m.chans[cmd] = nil, false
+		}
+	}
+	m.subs[s.ID] = nil, false
 }
 
-func (m *dispatchMap) DelListener(cmd, name string) os.Error {
+//disconnect closes every subscription of a slow channel and closes it
+func (m *dispatchMap) disconnect(ch chan *IrcMessage) {
 	m.lock.Lock()
-	defer m.lock.Unlock()
-	if m.chans[cmd] == nil || m.chans[cmd][name] == nil {
-		return os.NewError(fmt.Sprintf("No such listener: %s for cmd %s", name, cmd))
+	d, ok := m.deliveries[ch]
+	if !ok { //already gone
+		m.lock.Unlock()
+		return
 	}
-	if !closed(m.chans[cmd][name]) {
-		if msg, ok := <-m.chans[cmd][name]; msg != nil || ok {
-			close(m.chans[cmd][name])
+	for _, s := range m.subs {
+		if s.ch == ch {
+			m.remove(s)
 		}
 	}
-	m.chans[cmd][name] = nil, false
-	if len(m.chans[cmd]) == 0 {
-		m.chans[cmd] = nil, false
+	m.deliveries[ch] = nil, false
+	m.lock.Unlock()
+	d.stop(ch)
+}
+
+//SubscriptionInfo describes an active subscription, see Subscriptions
+type SubscriptionInfo struct {
+	ID         int64
+	Name       string
+	Cmds       []string
+	Registered int64
+	Filtered   bool
+	Handler    bool //registered with Handle, the channel isn't used
+	Policy     int
+	Len, Cap   int //of the listener channel
+	Stats      ListenerStats
+}
+
+func (i SubscriptionInfo) String() string {
+	name := i.Name
+	if name == "" {
+		name = "-"
+	}
+	kind := fmt.Sprintf("chan %d/%d", i.Len, i.Cap)
+	if i.Handler {
+		kind = "handler"
+	}
+	return fmt.Sprintf("#%d %s [%s] %s filtered=%t policy=%d registered=%s delivered=%d dropped=%d queued=%d",
+		i.ID, name, strings.Join(i.Cmds, ","), kind, i.Filtered, i.Policy,
+		time.SecondsToLocalTime(i.Registered/second).Format(time.RFC3339), i.Stats.Delivered, i.Stats.Dropped, i.Stats.Queued)
+}
+
+type subscriptionInfos []SubscriptionInfo
+
+func (s subscriptionInfos) Len() int           { return len(s) }
+func (s subscriptionInfos) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s subscriptionInfos) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+//Subscriptions lists the active subscriptions, oldest first. Subscriptions
+//sharing a channel share its name, options and counters.
+func (m *dispatchMap) Subscriptions() []SubscriptionInfo {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	ret := make(subscriptionInfos, 0, len(m.subs))
+	for _, s := range m.subs {
+		d := m.deliveries[s.ch]
+		ret = append(ret, SubscriptionInfo{s.ID, d.name, s.Cmds, s.Registered, d.filter != nil, d.handler != nil,
+			d.policy, len(s.ch), cap(s.ch), d.stats()})
+	}
+	sort.Sort(ret)
+	return ret
+}
+
+//Dump writes the active subscriptions to w, one per line
+func (m *dispatchMap) Dump(w io.Writer) os.Error {
+	for _, i := range m.Subscriptions() {
+		if _, err := fmt.Fprintln(w, i.String()); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+//DumpListeners writes the listeners of incoming and outgoing messages to w,
+//to find the ones that leak or stopped receiving
+func (n *Network) DumpListeners(w io.Writer) os.Error {
+	if _, err := fmt.Fprintln(w, "Listen:"); err != nil {
+		return err
+	}
+	if err := n.Listen.Dump(w); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(w, "OutListen:"); err != nil {
+		return err
+	}
+	return n.OutListen.Dump(w)
+}
+
+//dispatch queues msg for its listeners, it must be called in wire order from a
+//single goroutine. It only blocks for listeners with the BLOCK policy.
 func (m *dispatchMap) dispatch(msg IrcMessage) {
+	full := make(map[chan *IrcMessage]*delivery)
+	seen := make(map[chan *IrcMessage]bool)
 	m.lock.RLock()
-	for _, ch := range m.chans[msg.Cmd] {
-		_ = ch <- &msg
-	}
-	for _, ch := range m.chans["*"] {
-		_ = ch <- &msg
+	for _, cmd := range []string{msg.Cmd, "*"} {
+		for _, ch := range m.chans[cmd] {
+			if seen[ch] { //several subscriptions of the channel match
+				continue
+			}
+			seen[ch] = true
+			if d := m.deliveries[ch]; !d.push(&msg) {
+				full[ch] = d
+			}
+		}
 	}
 	m.lock.RUnlock()
+	for ch, d := range full {
+		if !d.overflow(&msg) {
+			m.disconnect(ch)
+		}
+	}
 	return
 }
 
+type shutdownClient struct {
+	name string
+	done chan bool //closed by the goroutine when it exits
+}
+
 type shutdownDispatcher struct {
 	lock    *sync.Mutex
-	clients []chan bool
+	quit    chan bool //closed to tell every registered goroutine to exit
+	clients []shutdownClient
 }
 
-func (s *shutdownDispatcher) Reg(ch chan bool) os.Error {
-	if len(ch) > 0 {
-		return os.NewError("Need to pass synchronous channel for shutdown")
-	}
+//Reg registers a goroutine for the next shutdown. The goroutine must return
+//once quit is closed and close done when it has exited.
+func (s *shutdownDispatcher) Reg(name string) (quit, done chan bool) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.clients = append(s.clients, ch)
-	return nil
+	done = make(chan bool)
+	s.clients = append(s.clients, shutdownClient{name, done})
+	return s.quit, done
 }
 
-func (s *shutdownDispatcher) do() int {
+//do closes the quit channel and waits up to wait nanoseconds for all the
+//registered goroutines to exit. The error names the ones that didn't.
+func (s *shutdownDispatcher) do(wait int64) os.Error {
 	s.lock.Lock()
-	defer s.lock.Unlock()
-	stale := 0
-	for i, _ := range s.clients {
-		ok := s.clients[i] <- true
-		if !ok {
-			stale++
+	close(s.quit)
+	clients := s.clients
+	s.quit = make(chan bool)
+	s.clients = make([]shutdownClient, 0)
+	s.lock.Unlock()
+	deadline := time.NewTicker(wait)
+	defer deadline.Stop()
+	expired := false
+	stale := make([]string, 0)
+	for _, c := range clients {
+		if !expired {
+			select {
+			case <-c.done:
+				continue
+			case <-deadline.C:
+				expired = true
+			}
 		}
+		select {
+		case <-c.done:
+		default:
+			stale = append(stale, c.name)
+		}
+	}
+	if len(stale) > 0 {
+		return os.NewError(fmt.Sprintf("Goroutines didn't stop in time: %s", strings.Join(stale, ", ")))
 	}
-	s.clients = make([]chan bool, 0)
-	return stale
+	return nil
 }
@@ -0,0 +1,203 @@
+package ircchans
+
+import (
+	"os"
+	"log"
+	"runtime"
+	"testing"
+	"strconv"
+	"time"
+)
+
+var testlog = log.New(os.Stderr, "", log.Ldate|log.Lmicroseconds)
+
+func TestDispatchOrder(t *testing.T) {
+	m := newDispatchMap(testlog)
+	ch := make(chan *IrcMessage) //unbuffered: every message goes through the queue
+	sub, _ := m.RegListener([]string{"JOIN", "PART"}, ch, Overflow(BLOCK, minute))
+	for i := 0; i < 100; i++ {
+		cmd := "JOIN"
+		if i%2 == 1 {
+			cmd = "PART"
+		}
+		m.dispatch(IrcMessage{"", cmd, []string{strconv.Itoa(i)}, nil})
+	}
+	for i := 0; i < 100; i++ {
+		msg := <-ch
+		if msg.Params[0] != strconv.Itoa(i) {
+			t.Fatalf("Got message %s, expected %d", msg.Params[0], i)
+		}
+	}
+	sub.Close()
+	if len(m.deliveries) != 0 || len(m.chans) != 0 {
+		t.Errorf("Delivery still running after removing its listeners")
+	}
+}
+
+func TestDispatchOnce(t *testing.T) {
+	m := newDispatchMap(testlog)
+	ch := make(chan *IrcMessage, 10)
+	sub1, _ := m.RegListener([]string{"PRIVMSG"}, ch)
+	sub2, _ := m.RegListener([]string{"*", "PRIVMSG"}, ch)
+	m.dispatch(IrcMessage{"", "PRIVMSG", []string{"#a", "1"}, nil})
+	m.dispatch(IrcMessage{"", "NOTICE", []string{"#a", "2"}, nil})
+	for _, expected := range []string{"1", "2"} {
+		if msg := <-ch; msg.Params[1] != expected {
+			t.Errorf("Got message %s, expected %s", msg.Params[1], expected)
+		}
+	}
+	if len(ch) != 0 {
+		t.Errorf("Got a message several times")
+	}
+	sub1.Close()
+	sub2.Close()
+}
+
+//waitStats waits up to a second for the delivery of sub to process what was
+//dispatched
+func waitStats(sub *Subscription, processed int64) ListenerStats {
+	deadline := time.Nanoseconds() + second
+	for {
+		s, err := sub.Stats()
+		if err != nil || s.Delivered+s.Dropped >= processed || time.Nanoseconds() > deadline {
+			return s
+		}
+		runtime.Gosched()
+	}
+	return ListenerStats{}
+}
+
+func TestDispatchOverflow(t *testing.T) {
+	m := newDispatchMap(testlog)
+	ch := make(chan *IrcMessage, 4)
+	sub, _ := m.RegListener([]string{"PRIVMSG"}, ch)
+	for i := 0; i < 10; i++ {
+		m.dispatch(IrcMessage{"", "PRIVMSG", []string{strconv.Itoa(i)}, nil})
+	}
+	if s := waitStats(sub, 10); s.Delivered != 4 || s.Dropped != 6 {
+		t.Errorf("DROPNEWEST: got %+v, expected 4 delivered and 6 dropped as soon as the channel was full", s)
+	}
+	sub.Close()
+
+	ch = make(chan *IrcMessage, 4)
+	sub, _ = m.RegListener([]string{"PRIVMSG"}, ch, Overflow(DROPOLDEST, 0))
+	for i := 0; i < 10; i++ {
+		m.dispatch(IrcMessage{"", "PRIVMSG", []string{strconv.Itoa(i)}, nil})
+	}
+	//every message is written, the 6 oldest are taken back out of the channel
+	if s := waitStats(sub, 16); s.Delivered != 10 || s.Dropped != 6 {
+		t.Errorf("DROPOLDEST: got %+v", s)
+	}
+	for i := 6; i < 10; i++ {
+		if msg := <-ch; msg.Params[0] != strconv.Itoa(i) {
+			t.Errorf("Got %s, expected the newest messages", msg.Params[0])
+		}
+	}
+	sub.Close()
+
+	slow := make(chan *IrcMessage, 2)
+	sub, _ = m.RegListener([]string{"PRIVMSG"}, slow, Overflow(DISCONNECT, 0))
+	for i := 0; i < 3; i++ {
+		m.dispatch(IrcMessage{"", "PRIVMSG", []string{strconv.Itoa(i)}, nil})
+	}
+	waitStats(sub, 3)
+	deadline := time.Nanoseconds() + second
+	for _, err := sub.Stats(); err == nil && time.Nanoseconds() < deadline; _, err = sub.Stats() {
+		runtime.Gosched()
+	}
+	if _, err := sub.Stats(); err == nil {
+		t.Errorf("Slow listener wasn't disconnected once its channel was full")
+	}
+}
+
+func TestBlockUnlocked(t *testing.T) {
+	m := newDispatchMap(testlog)
+	blocked := make(chan *IrcMessage)
+	m.RegListener([]string{"PRIVMSG"}, blocked, Overflow(BLOCK, minute))
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < deliveryQueue+2; i++ { //fills the queue, then waits
+			m.dispatch(IrcMessage{"", "PRIVMSG", []string{strconv.Itoa(i)}, nil})
+		}
+		close(done)
+	}()
+	for len(m.deliveries[blocked].queue) < deliveryQueue {
+		runtime.Gosched()
+	}
+	sub, err := m.RegListener([]string{"NOTICE"}, make(chan *IrcMessage, 1)) //needs the write lock
+	if err != nil {
+		t.Fatalf("Register error: %s", err.String())
+	}
+	sub.Close()
+	for i := 0; i < deliveryQueue+2; i++ {
+		<-blocked
+	}
+	<-done
+}
+
+func TestSubscriptionIDs(t *testing.T) {
+	m := newDispatchMap(testlog)
+	ids := make(chan int64, 100)
+	for i := 0; i < 100; i++ {
+		go func() {
+			sub, err := m.RegListener([]string{"PRIVMSG"}, make(chan *IrcMessage))
+			if err != nil {
+				t.Errorf("Register error: %s", err.String())
+				ids <- 0
+				return
+			}
+			ids <- sub.ID
+			sub.Close()
+		}()
+	}
+	seen := make(map[int64]bool)
+	for i := 0; i < 100; i++ {
+		id := <-ids
+		if seen[id] {
+			t.Errorf("Subscription id %d given twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestSubscriptionInfo(t *testing.T) {
+	m := newDispatchMap(testlog)
+	ch := make(chan *IrcMessage, 5)
+	sub, _ := m.RegListener([]string{"JOIN"}, ch, Named("joins"), Filtered(FilterChannel("#chan")))
+	h, _ := m.Handle([]string{"*"}, func(msg *IrcMessage) {})
+	m.dispatch(IrcMessage{"", "JOIN", []string{"#chan"}, nil})
+	infos := m.Subscriptions()
+	if len(infos) != 2 || infos[0].ID != sub.ID || infos[1].ID != h.ID {
+		t.Fatalf("Bad subscriptions: %#v", infos)
+	}
+	<-ch
+	if i := infos[0]; i.Name != "joins" || !i.Filtered || i.Handler || i.Cap != 5 {
+		t.Errorf("Bad subscription info: %s", i)
+	}
+	if !infos[1].Handler {
+		t.Errorf("Handler not recognised: %s", infos[1])
+	}
+	h.Close()
+	if infos = m.Subscriptions(); len(infos) != 1 {
+		t.Errorf("Closed subscription still listed: %#v", infos)
+	}
+	sub.Close()
+}
+
+func TestOverflowCheck(t *testing.T) {
+	m := newDispatchMap(testlog)
+	ch := make(chan *IrcMessage)
+	for _, opt := range []ListenerOption{Overflow(BLOCK, 0), Overflow(BLOCK, -1), Overflow(42, second)} {
+		if _, err := m.RegListener([]string{"PRIVMSG"}, ch, opt); err == nil {
+			t.Errorf("Registered with a bad overflow option")
+		}
+	}
+	if len(m.subs) != 0 || len(m.deliveries) != 0 {
+		t.Errorf("Rejected listener left behind")
+	}
+	sub, err := m.RegListener([]string{"PRIVMSG"}, ch, Overflow(BLOCK, second))
+	if err != nil {
+		t.Fatalf("Couldn't register with BLOCK: %s", err.String())
+	}
+	sub.Close()
+}
@@ -0,0 +1,311 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"strings"
+)
+
+//Event is a message decoded into the fields of its command, see Decode
+type Event interface {
+	Message() *IrcMessage
+}
+
+//Source is the sender of a message, a user or a server (Nick only)
+type Source struct {
+	Nick, User, Host string
+}
+
+func ParseSource(prefix string) Source {
+	var s Source
+	s.Nick = prefix
+	if i := strings.Index(s.Nick, "@"); i > -1 {
+		s.Host = s.Nick[i+1:]
+		s.Nick = s.Nick[:i]
+	}
+	if i := strings.Index(s.Nick, "!"); i > -1 {
+		s.User = s.Nick[i+1:]
+		s.Nick = s.Nick[:i]
+	}
+	return s
+}
+
+//EventBase holds what every event has
+type EventBase struct {
+	Msg    *IrcMessage
+	Source Source
+}
+
+func (e *EventBase) Message() *IrcMessage {
+	return e.Msg
+}
+
+type PrivmsgEvent struct {
+	EventBase
+	Target, Text string
+}
+
+type NoticeEvent struct {
+	EventBase
+	Target, Text string
+}
+
+//CtcpEvent is a ctcp request sent in a PRIVMSG, or a reply sent in a NOTICE
+type CtcpEvent struct {
+	EventBase
+	Target, Command, Args string
+	Reply                 bool
+}
+
+type JoinEvent struct {
+	EventBase
+	Channel  string
+	Account  string //with extended-join, empty otherwise or if not logged in
+	Realname string //with extended-join
+}
+
+type PartEvent struct {
+	EventBase
+	Channel, Reason string
+}
+
+type KickEvent struct {
+	EventBase
+	Channel, Nick, Reason string
+}
+
+type QuitEvent struct {
+	EventBase
+	Reason string
+}
+
+type NickEvent struct {
+	EventBase
+	Old, New string
+}
+
+type ModeEvent struct {
+	EventBase
+	Target, Modes string
+	Params        []string
+}
+
+type TopicEvent struct {
+	EventBase
+	Channel, Topic string
+}
+
+type InviteEvent struct {
+	EventBase
+	Nick, Channel string
+}
+
+//NumericEvent is a numeric reply, Params don't include our nick
+type NumericEvent struct {
+	EventBase
+	Code   string
+	Name   string //like RPL_WELCOME, empty if unknown
+	Params []string
+}
+
+//replyName finds the name of a numeric, the first in alphabetical order when
+//several share it
+func replyName(code string) string {
+	ret := ""
+	for name, c := range replies {
+		if c == code && (ret == "" || name < ret) {
+			ret = name
+		}
+	}
+	return ret
+}
+
+//Decode turns msg into its event. Commands without an event give nil and no
+//error, messages missing parameters give an error.
+func Decode(msg *IrcMessage) (Event, os.Error) {
+	base := EventBase{msg, ParseSource(msg.Prefix)}
+	p := msg.Params
+	need := 0
+	switch msg.Cmd {
+	case "PRIVMSG", "NOTICE", "KICK", "TOPIC", "INVITE":
+		need = 2
+	case "JOIN", "PART", "NICK", "MODE":
+		need = 1
+	}
+	if len(p) < need {
+		return nil, os.NewError(fmt.Sprintf("Can't decode %s: %d parameters, expected %d", msg.Cmd, len(p), need))
+	}
+	switch msg.Cmd {
+	case "PRIVMSG", "NOTICE":
+		if text := p[1]; len(text) > 1 && text[0] == '\x01' {
+			text = strings.Trim(text, "\x01")
+			ctcp := strings.Split(text, " ", 2)
+			e := &CtcpEvent{base, p[0], ctcp[0], "", msg.Cmd == "NOTICE"}
+			if len(ctcp) > 1 {
+				e.Args = ctcp[1]
+			}
+			return e, nil
+		}
+		if msg.Cmd == "NOTICE" {
+			return &NoticeEvent{base, p[0], p[1]}, nil
+		}
+		return &PrivmsgEvent{base, p[0], p[1]}, nil
+	case "JOIN":
+		e := &JoinEvent{EventBase: base, Channel: p[0]}
+		if len(p) > 2 {
+			if p[1] != "*" {
+				e.Account = p[1]
+			}
+			e.Realname = p[2]
+		}
+		return e, nil
+	case "PART":
+		e := &PartEvent{EventBase: base, Channel: p[0]}
+		if len(p) > 1 {
+			e.Reason = p[1]
+		}
+		return e, nil
+	case "KICK":
+		e := &KickEvent{EventBase: base, Channel: p[0], Nick: p[1]}
+		if len(p) > 2 {
+			e.Reason = p[2]
+		}
+		return e, nil
+	case "QUIT":
+		e := &QuitEvent{EventBase: base}
+		if len(p) > 0 {
+			e.Reason = p[0]
+		}
+		return e, nil
+	case "NICK":
+		return &NickEvent{base, base.Source.Nick, p[0]}, nil
+	case "MODE":
+		e := &ModeEvent{base, p[0], "", make([]string, 0)}
+		if len(p) > 1 {
+			e.Modes = p[1]
+			e.Params = p[2:]
+		}
+		return e, nil
+	case "TOPIC":
+		return &TopicEvent{base, p[0], p[1]}, nil
+	case "INVITE":
+		return &InviteEvent{base, p[0], p[1]}, nil
+	}
+	if isNumeric(msg.Cmd) {
+		e := &NumericEvent{base, msg.Cmd, replyName(msg.Cmd), make([]string, 0)}
+		if len(p) > 1 {
+			e.Params = p[1:]
+		}
+		return e, nil
+	}
+	return nil, nil
+}
+
+//HandleEvents registers h to be called with the events of the commands,
+//messages that can't be decoded are skipped
+func (m *dispatchMap) HandleEvents(cmds []string, h func(Event), opts ...ListenerOption) (*Subscription, os.Error) {
+	return m.Handle(cmds, func(msg *IrcMessage) {
+		if e, err := Decode(msg); err == nil && e != nil {
+			h(e)
+		}
+	}, opts...)
+}
+
+func (m *dispatchMap) HandlePrivmsg(h func(*PrivmsgEvent), opts ...ListenerOption) (*Subscription, os.Error) {
+	return m.HandleEvents([]string{"PRIVMSG"}, func(e Event) {
+		if ev, ok := e.(*PrivmsgEvent); ok {
+			h(ev)
+		}
+	}, opts...)
+}
+
+func (m *dispatchMap) HandleNotice(h func(*NoticeEvent), opts ...ListenerOption) (*Subscription, os.Error) {
+	return m.HandleEvents([]string{"NOTICE"}, func(e Event) {
+		if ev, ok := e.(*NoticeEvent); ok {
+			h(ev)
+		}
+	}, opts...)
+}
+
+//HandleCtcp gets the ctcp requests and replies, not the plain messages
+func (m *dispatchMap) HandleCtcp(h func(*CtcpEvent), opts ...ListenerOption) (*Subscription, os.Error) {
+	return m.HandleEvents([]string{"PRIVMSG", "NOTICE"}, func(e Event) {
+		if ev, ok := e.(*CtcpEvent); ok {
+			h(ev)
+		}
+	}, opts...)
+}
+
+func (m *dispatchMap) HandleJoin(h func(*JoinEvent), opts ...ListenerOption) (*Subscription, os.Error) {
+	return m.HandleEvents([]string{"JOIN"}, func(e Event) {
+		if ev, ok := e.(*JoinEvent); ok {
+			h(ev)
+		}
+	}, opts...)
+}
+
+func (m *dispatchMap) HandlePart(h func(*PartEvent), opts ...ListenerOption) (*Subscription, os.Error) {
+	return m.HandleEvents([]string{"PART"}, func(e Event) {
+		if ev, ok := e.(*PartEvent); ok {
+			h(ev)
+		}
+	}, opts...)
+}
+
+func (m *dispatchMap) HandleKick(h func(*KickEvent), opts ...ListenerOption) (*Subscription, os.Error) {
+	return m.HandleEvents([]string{"KICK"}, func(e Event) {
+		if ev, ok := e.(*KickEvent); ok {
+			h(ev)
+		}
+	}, opts...)
+}
+
+func (m *dispatchMap) HandleQuit(h func(*QuitEvent), opts ...ListenerOption) (*Subscription, os.Error) {
+	return m.HandleEvents([]string{"QUIT"}, func(e Event) {
+		if ev, ok := e.(*QuitEvent); ok {
+			h(ev)
+		}
+	}, opts...)
+}
+
+func (m *dispatchMap) HandleNick(h func(*NickEvent), opts ...ListenerOption) (*Subscription, os.Error) {
+	return m.HandleEvents([]string{"NICK"}, func(e Event) {
+		if ev, ok := e.(*NickEvent); ok {
+			h(ev)
+		}
+	}, opts...)
+}
+
+func (m *dispatchMap) HandleMode(h func(*ModeEvent), opts ...ListenerOption) (*Subscription, os.Error) {
+	return m.HandleEvents([]string{"MODE"}, func(e Event) {
+		if ev, ok := e.(*ModeEvent); ok {
+			h(ev)
+		}
+	}, opts...)
+}
+
+func (m *dispatchMap) HandleTopic(h func(*TopicEvent), opts ...ListenerOption) (*Subscription, os.Error) {
+	return m.HandleEvents([]string{"TOPIC"}, func(e Event) {
+		if ev, ok := e.(*TopicEvent); ok {
+			h(ev)
+		}
+	}, opts...)
+}
+
+func (m *dispatchMap) HandleInvite(h func(*InviteEvent), opts ...ListenerOption) (*Subscription, os.Error) {
+	return m.HandleEvents([]string{"INVITE"}, func(e Event) {
+		if ev, ok := e.(*InviteEvent); ok {
+			h(ev)
+		}
+	}, opts...)
+}
+
+//HandleNumeric gets the numeric replies named in names (see replies), like
+//RPL_TOPIC, or given by their code
+func (m *dispatchMap) HandleNumeric(names []string, h func(*NumericEvent), opts ...ListenerOption) (*Subscription, os.Error) {
+	return m.HandleEvents(replyCodes(names...), func(e Event) {
+		if ev, ok := e.(*NumericEvent); ok {
+			h(ev)
+		}
+	}, opts...)
+}
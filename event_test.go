@@ -0,0 +1,30 @@
+package ircchans
+
+import (
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	msg := &IrcMessage{"op!o@host", "KICK", []string{"#chan", "bob", "bye"}, nil}
+	e, err := Decode(msg)
+	if err != nil {
+		t.Fatalf("Couldn't decode KICK: %s", err.String())
+	}
+	if k, ok := e.(*KickEvent); !ok || k.Source.Nick != "op" || k.Source.Host != "host" || k.Channel != "#chan" || k.Nick != "bob" || k.Reason != "bye" {
+		t.Errorf("Bad kick event: %#v", e)
+	}
+	e, _ = Decode(&IrcMessage{"bob!b@h", "PRIVMSG", []string{"me", "\x01PING 123\x01"}, nil})
+	if c, ok := e.(*CtcpEvent); !ok || c.Command != "PING" || c.Args != "123" || c.Reply {
+		t.Errorf("Bad ctcp event: %#v", e)
+	}
+	e, _ = Decode(&IrcMessage{"server", "332", []string{"me", "#chan", "the topic"}, nil})
+	if num, ok := e.(*NumericEvent); !ok || num.Name != "RPL_TOPIC" || len(num.Params) != 2 {
+		t.Errorf("Bad numeric event: %#v", e)
+	}
+	if _, err := Decode(&IrcMessage{"op", "KICK", []string{"#chan"}, nil}); err == nil {
+		t.Errorf("KICK without a nick decoded")
+	}
+	if e, err := Decode(&IrcMessage{"", "PING", []string{"x"}, nil}); e != nil || err != nil {
+		t.Errorf("PING decoded: %#v %v", e, err)
+	}
+}
@@ -38,27 +38,20 @@ func main() {
 	channels := strings.Split(*chans, ",", -1)
 	n := ircchans.NewNetwork(*netf, *port, *nickf, *userf, *rnf, *passf, *logfile)
 	//test replies, outgoing messages
-	go func() {
-		chin := make(chan *ircchans.IrcMessage, 100)
-		n.Listen.RegListener("PRIVMSG", "testreply", chin)
-		for !closed(chin) {
-			msg := <-chin
-			nick := n.GetNick()
-			if msg.Destination() == nick {
-				switch strings.Join(msg.Params[1:], " ") {
-				case "memusage":
-					targ := strings.Split(msg.Prefix, "!", 2)
-					n.Privmsg([]string{targ[0]}, fmt.Sprintf("Currently allocated: %.2fMb, taken from system: %.2fMb", float32(runtime.MemStats.Alloc)/1024/1024, float32(runtime.MemStats.Sys)/1024/1024))
-					n.Privmsg([]string{targ[0]}, fmt.Sprintf("Currently allocated (heap): %.2fMb, taken from system (heap): %.2fMb", float32(runtime.MemStats.HeapAlloc)/1024/1024, float32(runtime.MemStats.HeapSys)/1024/1024))
-					n.Privmsg([]string{targ[0]}, fmt.Sprintf("Goroutines currently running: %d", runtime.Goroutines()))
-					n.Privmsg([]string{targ[0]}, fmt.Sprintf("Next garbage collection will be when heap reaches %.1f Mb.", float32(runtime.MemStats.NextGC)/1024/1024))
-				case "reconnect":
-					n.Disconnect("Order")
-				}
-			}
+	n.Listen.Handle([]string{"PRIVMSG"}, ircchans.Chain(func(msg *ircchans.IrcMessage) {
+		targ := strings.Split(msg.Prefix, "!", 2)
+		switch strings.Join(msg.Params[1:], " ") {
+		case "memusage":
+			n.Privmsg([]string{targ[0]}, fmt.Sprintf("Currently allocated: %.2fMb, taken from system: %.2fMb", float32(runtime.MemStats.Alloc)/1024/1024, float32(runtime.MemStats.Sys)/1024/1024))
+			n.Privmsg([]string{targ[0]}, fmt.Sprintf("Currently allocated (heap): %.2fMb, taken from system (heap): %.2fMb", float32(runtime.MemStats.HeapAlloc)/1024/1024, float32(runtime.MemStats.HeapSys)/1024/1024))
+			n.Privmsg([]string{targ[0]}, fmt.Sprintf("Goroutines currently running: %d", runtime.Goroutines()))
+			n.Privmsg([]string{targ[0]}, fmt.Sprintf("Next garbage collection will be when heap reaches %.1f Mb.", float32(runtime.MemStats.NextGC)/1024/1024))
+		case "reconnect":
+			n.Disconnect("Order")
 		}
-		n.Listen.DelListener("PRIVMSG", "testreply")
-	}()
+	}, ircchans.Recover(nil), ircchans.RateLimit(5, minute), ircchans.Only(func(msg *ircchans.IrcMessage) bool {
+		return msg.Destination() == n.GetNick()
+	})))
 	ticker := time.Tick(1000 * 1000 * 1000 * 15)
 	ticker15 := time.Tick(1000 * 1000 * 1000 * 60 * 15)
 	for !closed(ticker) {
@@ -0,0 +1,144 @@
+package ircchans
+
+import (
+	"regexp"
+	"strings"
+)
+
+//Filter tells whether a listener wants a message. Filters are evaluated by the
+//dispatcher, before the message is queued for the listener.
+type Filter func(msg *IrcMessage) bool
+
+//Filtered makes a listener receive only the messages f accepts. The filter
+//applies to the channel, whatever command it's registered for.
+func Filtered(f Filter) ListenerOption {
+	return func(d *delivery) {
+		d.filter = f
+	}
+}
+
+//rfc1459 folds the names for the filters not bound to a network
+var rfc1459 = defaultISupport()
+
+func rfc1459Support() *ISupport {
+	return rfc1459
+}
+
+//FilterChannel accepts the messages whose target is one of chans, e.g. a
+//PRIVMSG, JOIN or MODE on one of them. Names are compared with the rfc1459
+//casemapping, Network.FilterChannel uses the server's.
+func FilterChannel(chans ...string) Filter {
+	return filterChannel(rfc1459Support, chans)
+}
+
+//FilterSource accepts the messages whose prefix (nick!user@host) matches one
+//of the glob masks, where * matches any string and ? any character. They're
+//compared with the rfc1459 casemapping, Network.FilterSource uses the server's.
+func FilterSource(masks ...string) Filter {
+	return filterSource(rfc1459Support, masks)
+}
+
+//FilterChannel is like the FilterChannel function but folds the names with
+//the casemapping of the server at the time of the message
+func (n *Network) FilterChannel(chans ...string) Filter {
+	return filterChannel(n.isupport.get, chans)
+}
+
+//FilterSource is like the FilterSource function but folds the masks with the
+//casemapping of the server at the time of the message
+func (n *Network) FilterSource(masks ...string) Filter {
+	return filterSource(n.isupport.get, masks)
+}
+
+func filterChannel(isupport func() *ISupport, chans []string) Filter {
+	return func(msg *IrcMessage) bool {
+		if len(msg.Params) == 0 {
+			return false
+		}
+		s := isupport()
+		for _, target := range strings.Split(msg.Params[0], ",", -1) {
+			for _, ch := range chans {
+				if s.Fold(target) == s.Fold(ch) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+func filterSource(isupport func() *ISupport, masks []string) Filter {
+	return func(msg *IrcMessage) bool {
+		s := isupport()
+		for _, mask := range masks {
+			if globMatch(s.Fold(mask), s.Fold(msg.Prefix)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+//FilterText accepts the messages whose last parameter, the text of a PRIVMSG
+//or NOTICE, matches re
+func FilterText(re *regexp.Regexp) Filter {
+	return func(msg *IrcMessage) bool {
+		return len(msg.Params) > 0 && re.MatchString(msg.Params[len(msg.Params)-1])
+	}
+}
+
+//And accepts the messages every filter accepts
+func And(filters ...Filter) Filter {
+	return func(msg *IrcMessage) bool {
+		for _, f := range filters {
+			if !f(msg) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+//Or accepts the messages any filter accepts
+func Or(filters ...Filter) Filter {
+	return func(msg *IrcMessage) bool {
+		for _, f := range filters {
+			if f(msg) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+//Not accepts the messages f rejects
+func Not(f Filter) Filter {
+	return func(msg *IrcMessage) bool {
+		return !f(msg)
+	}
+}
+
+//globMatch matches s against a pattern where * is any string and ? any byte
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,69 @@
+package ircchans
+
+import (
+	"log"
+	"bytes"
+	"testing"
+	"regexp"
+	"strings"
+)
+
+func TestFilters(t *testing.T) {
+	msg := &IrcMessage{"op!ops@trusted.host", "PRIVMSG", []string{"#Ops", "!deploy now"}, nil}
+	f := And(FilterChannel("#ops"), FilterSource("*!*@trusted.host"), FilterText(regexp.MustCompile("^!deploy")))
+	if !f(msg) {
+		t.Errorf("Filter rejected %s", msg)
+	}
+	msg.Prefix = "op!ops@evil.host"
+	if f(msg) {
+		t.Errorf("Filter accepted %s", msg)
+	}
+	if !Or(f, FilterSource("op!*"))(msg) {
+		t.Errorf("Or filter rejected %s", msg)
+	}
+	for _, c := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"a?c", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"*@*.host", "n!u@trusted.host", true},
+	} {
+		if globMatch(c.pattern, c.s) != c.match {
+			t.Errorf("globMatch(%q, %q) != %v", c.pattern, c.s, c.match)
+		}
+	}
+}
+
+func TestFilterCasemapping(t *testing.T) {
+	msg := &IrcMessage{"Op[1]!ops@host", "PRIVMSG", []string{"#OPS{1}", "hi"}, nil}
+	if !FilterChannel("#ops[1]")(msg) || !FilterSource("op{1}!*")(msg) {
+		t.Errorf("Names not folded with rfc1459")
+	}
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	f := n.FilterChannel("#ops[1]")
+	if !f(msg) {
+		t.Errorf("Names not folded with the default casemapping")
+	}
+	n.isupport.update([]string{"CASEMAPPING=ascii"})
+	if f(msg) || n.FilterSource("op{1}!*")(msg) {
+		t.Errorf("Names not folded with the server's casemapping")
+	}
+	if !n.FilterChannel("#ops{1}")(msg) {
+		t.Errorf("Names not folded with ascii")
+	}
+}
+
+func TestPanickingFilter(t *testing.T) {
+	buf := bytes.NewBufferString("")
+	d := newDelivery(log.New(buf, "", 0))
+	Filtered(func(msg *IrcMessage) bool { return msg.Params[1] == "" })(d)
+	if !d.push(&IrcMessage{"", "PING", []string{}, nil}) || len(d.queue) != 0 {
+		t.Errorf("Message accepted by a panicking filter")
+	}
+	if !strings.Contains(buf.String(), "panicked") {
+		t.Errorf("Panic not logged to the network's logger: %q", buf.String())
+	}
+}
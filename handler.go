@@ -0,0 +1,95 @@
+package ircchans
+
+import (
+	"os"
+	"log"
+	"sync"
+	"time"
+)
+
+//HandlerFunc handles a message. Handlers registered with Handle are called in
+//wire order, one message at a time.
+type HandlerFunc func(msg *IrcMessage)
+
+//Middleware wraps a handler with some behaviour
+type Middleware func(h HandlerFunc) HandlerFunc
+
+//Chain wraps h with the middlewares, the first one is the outermost
+func Chain(h HandlerFunc, mws ...Middleware) HandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+//Handle registers h to be called with the messages of the commands, "*" being
+//every command. It is a listener like the ones of RegListener and takes the
+//same options; closing the subscription unregisters it.
+func (m *dispatchMap) Handle(cmds []string, h HandlerFunc, opts ...ListenerOption) (*Subscription, os.Error) {
+	ch := make(chan *IrcMessage) //identifies the listener, nothing is sent on it
+	opts = append([]ListenerOption{func(d *delivery) { d.handler = h }}, opts...)
+	return m.RegListener(cmds, ch, opts...)
+}
+
+//Recover keeps a panicking handler from taking the program down, the panic is
+//logged to l, or the standard logger if l is nil
+func Recover(l *log.Logger) Middleware {
+	return func(h HandlerFunc) HandlerFunc {
+		return func(msg *IrcMessage) {
+			defer func() {
+				if err := recover(); err != nil {
+					if l != nil {
+						l.Printf("Handler panicked on %s: %v", msg, err)
+					} else {
+						log.Printf("Handler panicked on %s: %v", msg, err)
+					}
+				}
+			}()
+			h(msg)
+		}
+	}
+}
+
+//Logging logs every message to l before handling it
+func Logging(l *log.Logger) Middleware {
+	return func(h HandlerFunc) HandlerFunc {
+		return func(msg *IrcMessage) {
+			l.Printf("Handling %s", msg)
+			h(msg)
+		}
+	}
+}
+
+//RateLimit lets at most count messages through every per nanoseconds, the
+//others are dropped
+func RateLimit(count int, per int64) Middleware {
+	lock := new(sync.Mutex)
+	times := make([]int64, 0, count) //when the last messages went through
+	return func(h HandlerFunc) HandlerFunc {
+		return func(msg *IrcMessage) {
+			now := time.Nanoseconds()
+			lock.Lock()
+			for len(times) > 0 && times[0] <= now-per {
+				times = times[1:]
+			}
+			if len(times) >= count {
+				lock.Unlock()
+				return
+			}
+			times = append(times, now)
+			lock.Unlock()
+			h(msg)
+		}
+	}
+}
+
+//Only handles the messages f accepts
+func Only(f Filter) Middleware {
+	return func(h HandlerFunc) HandlerFunc {
+		return func(msg *IrcMessage) {
+			if f(msg) {
+				h(msg)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package ircchans
+
+import (
+	"testing"
+	"log"
+	"os"
+	"time"
+)
+
+func TestHandle(t *testing.T) {
+	m := newDispatchMap(testlog)
+	got := make(chan string, 10)
+	h := Chain(func(msg *IrcMessage) {
+		if msg.Params[0] == "panic" {
+			panic("handler")
+		}
+		got <- msg.Params[0]
+	}, Recover(log.New(os.Stderr, "", 0)), RateLimit(3, minute))
+	sub, err := m.Handle([]string{"PRIVMSG"}, h)
+	if err != nil {
+		t.Fatalf("Couldn't register handler: %s", err.String())
+	}
+	for _, p := range []string{"a", "panic", "b", "c", "d"} {
+		m.dispatch(IrcMessage{"", "PRIVMSG", []string{p}, nil})
+	}
+	for _, want := range []string{"a", "b"} {
+		if p := <-got; p != want {
+			t.Errorf("Got %s, expected %s", p, want)
+		}
+	}
+	sub.Close()
+	if len(got) != 0 {
+		t.Errorf("Rate limit let %d more messages through", len(got))
+	}
+}
+
+func TestHandlerClosesItself(t *testing.T) {
+	m := newDispatchMap(testlog)
+	closed := make(chan os.Error, 1)
+	var sub *Subscription
+	sub, _ = m.Handle([]string{"PRIVMSG"}, func(msg *IrcMessage) {
+		closed <- sub.Close()
+	})
+	m.dispatch(IrcMessage{"", "PRIVMSG", []string{"once"}, nil})
+	ticker := time.NewTicker(second)
+	defer ticker.Stop()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Couldn't close from the handler: %s", err.String())
+		}
+	case <-ticker.C:
+		t.Fatalf("Handler deadlocked closing its subscription")
+	}
+	m.dispatch(IrcMessage{"", "PRIVMSG", []string{"twice"}, nil}) //must not block
+	if _, err := m.RegListener([]string{"PRIVMSG"}, make(chan *IrcMessage)); err != nil {
+		t.Errorf("Couldn't register after the handler closed: %s", err.String())
+	}
+	if len(closed) != 0 || len(m.subs) != 1 {
+		t.Errorf("Handler called after closing its subscription")
+	}
+}
@@ -0,0 +1,156 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Interceptor is called by the sender with every message before it's written.
+//It returns the messages to send in its place: msg itself, changed or not,
+//others, or several to split it. Returning none or an error drops msg, the
+//error giving the reason.
+type Interceptor func(msg *IrcMessage) ([]*IrcMessage, os.Error)
+
+type namedInterceptor struct {
+	name string
+	f    Interceptor
+}
+
+type interceptorChain struct {
+	lock     *sync.Mutex
+	chain    []namedInterceptor //in the order they're called
+	verdicts map[*IrcMessage]chan os.Error //by the copy queued for each send
+}
+
+func newInterceptorChain() *interceptorChain {
+	return &interceptorChain{new(sync.Mutex), make([]namedInterceptor, 0), make(map[*IrcMessage]chan os.Error)}
+}
+
+//call runs the interceptor, a panic drops msg instead of killing the sender
+func (i namedInterceptor) call(msg *IrcMessage) (res []*IrcMessage, err os.Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, os.NewError(fmt.Sprintf("panicked: %v", r))
+		}
+	}()
+	return i.f(msg)
+}
+
+//run passes msg through the chain, the error tells what was dropped and why
+func (c *interceptorChain) run(msg *IrcMessage) ([]*IrcMessage, os.Error) {
+	c.lock.Lock()
+	chain := c.chain
+	c.lock.Unlock()
+	msgs := []*IrcMessage{msg}
+	reasons := make([]string, 0)
+	for _, i := range chain {
+		out := make([]*IrcMessage, 0, len(msgs))
+		for _, m := range msgs {
+			res, err := i.call(m)
+			if err != nil {
+				reasons = append(reasons, fmt.Sprintf("%s dropped by %s: %s", m.Cmd, i.name, err.String()))
+				continue
+			}
+			if len(res) == 0 {
+				reasons = append(reasons, fmt.Sprintf("%s dropped by %s", m.Cmd, i.name))
+				continue
+			}
+			out = append(out, res...)
+		}
+		msgs = out
+	}
+	if len(reasons) > 0 {
+		return msgs, os.NewError(strings.Join(reasons, ", "))
+	}
+	return msgs, nil
+}
+
+//expect prepares for waiting on the verdict about msg. It returns the message
+//to queue: a copy only used for this send, so the caller may send msg again
+//before the verdict. The channel is nil when there are no interceptors, msg is
+//sent as is.
+func (c *interceptorChain) expect(msg *IrcMessage) (*IrcMessage, chan os.Error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.chain) == 0 {
+		return msg, nil
+	}
+	out := &IrcMessage{msg.Prefix, msg.Cmd, msg.Params, msg.Tags}
+	ch := make(chan os.Error, 1)
+	c.verdicts[out] = ch
+	return out, ch
+}
+
+//verdict tells the one waiting for msg whether it was sent as is
+func (c *interceptorChain) verdict(msg *IrcMessage, err os.Error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if ch, ok := c.verdicts[msg]; ok {
+		ch <- err
+		c.verdicts[msg] = nil, false
+	}
+}
+
+//wait waits for the verdict about msg. A message still queued after the
+//timeout is assumed to go through.
+func (c *interceptorChain) wait(msg *IrcMessage, ch chan os.Error, timeout int64) os.Error {
+	if ch == nil {
+		return nil
+	}
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+	select {
+	case err := <-ch:
+		return err
+	case <-ticker.C:
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.verdicts[msg] = nil, false
+	return nil
+}
+
+//AddInterceptor appends i to the chain of interceptors called on every
+//outgoing message, after the ones already added
+func (n *Network) AddInterceptor(name string, i Interceptor) os.Error {
+	if i == nil {
+		return os.NewError(fmt.Sprintf("Can't add interceptor %s: nil function", name))
+	}
+	n.interceptors.lock.Lock()
+	defer n.interceptors.lock.Unlock()
+	for _, c := range n.interceptors.chain {
+		if c.name == name {
+			return os.NewError(fmt.Sprintf("Can't add interceptor %s: already added", name))
+		}
+	}
+	chain := make([]namedInterceptor, len(n.interceptors.chain), len(n.interceptors.chain)+1)
+	copy(chain, n.interceptors.chain) //the sender may be running the old one
+	n.interceptors.chain = append(chain, namedInterceptor{name, i})
+	return nil
+}
+
+func (n *Network) DelInterceptor(name string) os.Error {
+	n.interceptors.lock.Lock()
+	defer n.interceptors.lock.Unlock()
+	for i, c := range n.interceptors.chain {
+		if c.name == name {
+			chain := make([]namedInterceptor, 0, len(n.interceptors.chain)-1)
+			chain = append(chain, n.interceptors.chain[:i]...)
+			n.interceptors.chain = append(chain, n.interceptors.chain[i+1:]...)
+			return nil
+		}
+	}
+	return os.NewError(fmt.Sprintf("Can't delete interceptor %s: not added", name))
+}
+
+//Send queues msg and, when there are interceptors, waits for it to go through
+//them: the error tells why it, or some of the messages it was split in, was
+//dropped
+func (n *Network) Send(msg *IrcMessage) os.Error {
+	out, verdict := n.interceptors.expect(msg)
+	n.queueOut <- out
+	return n.interceptors.wait(out, verdict, n.timeout())
+}
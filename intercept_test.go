@@ -0,0 +1,85 @@
+package ircchans
+
+import (
+	"os"
+	"testing"
+)
+
+func TestInterceptors(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	n.AddInterceptor("staging", func(msg *IrcMessage) ([]*IrcMessage, os.Error) {
+		if msg.Cmd == "PRIVMSG" && msg.Params[0] == "#prod" {
+			return nil, os.NewError("no messages to #prod")
+		}
+		return []*IrcMessage{msg}, nil
+	})
+	n.AddInterceptor("split", func(msg *IrcMessage) ([]*IrcMessage, os.Error) {
+		if msg.Cmd != "JOIN" {
+			return []*IrcMessage{msg}, nil
+		}
+		return []*IrcMessage{&IrcMessage{"", "JOIN", []string{"#a"}, nil}, &IrcMessage{"", "JOIN", []string{"#b"}, nil}}, nil
+	})
+	if err := n.AddInterceptor("split", func(msg *IrcMessage) ([]*IrcMessage, os.Error) { return nil, nil }); err == nil {
+		t.Errorf("Added the same interceptor twice")
+	}
+	if msgs, err := n.interceptors.run(&IrcMessage{"", "PRIVMSG", []string{"#prod", "hi"}, nil}); len(msgs) != 0 || err == nil {
+		t.Errorf("Message to #prod not dropped: %#v", msgs)
+	}
+	if msgs, err := n.interceptors.run(&IrcMessage{"", "JOIN", []string{"#a,#b"}, nil}); len(msgs) != 2 || err != nil {
+		t.Errorf("JOIN not split: %#v %v", msgs, err)
+	}
+	msg := &IrcMessage{"", "PRIVMSG", []string{"#prod", "hi"}, nil}
+	out1, ch1 := n.interceptors.expect(msg)
+	out2, ch2 := n.interceptors.expect(msg) //the same message sent twice
+	if out1 == out2 || out1 == msg {
+		t.Errorf("Sends of the same message share their verdict")
+	}
+	_, err := n.interceptors.run(out2)
+	n.interceptors.verdict(out2, err)
+	n.interceptors.verdict(out1, nil)
+	if err := n.interceptors.wait(out1, ch1, second); err != nil {
+		t.Errorf("Got the verdict of the other send: %s", err.String())
+	}
+	if err := n.interceptors.wait(out2, ch2, second); err == nil {
+		t.Errorf("Drop not reported")
+	}
+	if err := n.AddInterceptor("nil", nil); err == nil {
+		t.Errorf("Added a nil interceptor")
+	}
+	n.AddInterceptor("panic", func(msg *IrcMessage) ([]*IrcMessage, os.Error) {
+		return []*IrcMessage{msg}, os.NewError(msg.Params[5])
+	})
+	if msgs, err := n.interceptors.run(&IrcMessage{"", "PRIVMSG", []string{"#test", "hi"}, nil}); len(msgs) != 0 || err == nil {
+		t.Errorf("Panicking interceptor didn't drop the message: %#v", msgs)
+	}
+	n.DelInterceptor("panic")
+	n.DelInterceptor("staging")
+	n.DelInterceptor("split")
+	if out, ch := n.interceptors.expect(msg); ch != nil || out != msg {
+		t.Errorf("Waiting for a verdict without interceptors")
+	}
+}
+
+func TestCommandVeto(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	n.lags.add(1)
+	n.AddInterceptor("nopart", func(msg *IrcMessage) ([]*IrcMessage, os.Error) {
+		if msg.Cmd == "PART" {
+			return nil, os.NewError("staying")
+		}
+		return []*IrcMessage{msg}, nil
+	})
+	errch := make(chan os.Error, 1)
+	go func() {
+		errch <- n.Part([]string{"#chan"}, "bye")
+	}()
+	msg := <-n.queueOut //play the sender
+	msgs, verdict := n.interceptors.run(msg)
+	n.interceptors.verdict(msg, verdict)
+	if len(msgs) != 0 {
+		t.Errorf("PART not dropped")
+	}
+	if err := <-errch; err == nil {
+		t.Errorf("Part didn't report the drop")
+	}
+}
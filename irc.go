@@ -2,11 +2,8 @@ package ircchans
 
 import (
 	"os"
-	"net"
 	"log"
 	"fmt"
-	"strings"
-	"bufio"
 	"time"
 	"sync"
 	"encoding/pem"
@@ -31,17 +28,45 @@ var (
 
 type Network struct {
 	nick              string
+	prefnick          string //the nick we ask for, nick is the one we got
+	nickLock          *sync.Mutex
+	welcomed          bool //the welcome message named us, protected by nickLock
+	nicklisteners     *notifier
+	altnick           AltNickFunc
+	regainmode        int
+	regaincmd         string
+	regainpass        string
 	user              string
 	network, port     string
 	server            string
+	localaddr         string
+	bindaddr          string
+	ippref            int
 	realname          string
 	password          string
-	lag               int64
+	webirc            *webircConf
+	saslmechs         []SaslMechanism
+	saslpolicy        int
+	saslimplicit      bool //saslmechs set by SetIdentify
+	account           string
+	lags              *lagTracker
+	caps              *capSet
+	isupport          *isupportTracker
+	reg               *regTracker
+	services          *servicesState
+	correlator        *correlator
+	batches           *batchTracker
+	interceptors      *interceptorChain
+	shutdownTimeout   int64
 	queueOut          chan *IrcMessage
 	l                 *log.Logger
-	conn              net.Conn
+	scheme            string //irc, ircs, ws or wss; empty tries tls then plain-text
+	wspath            string
+	wsprotocol        string
+	stsport           string //tls port given by an sts policy on a plain-text connection, used by the next dial only
+	conn              transport
+	connLock          *sync.Mutex
 	Disconnected      bool
-	buf               *bufio.ReadWriter
 	Listen, OutListen dispatchMap
 	Shutdown          shutdownDispatcher
 }
@@ -50,7 +75,7 @@ type Network struct {
 func CustomTlsConf() (*tls.Config, os.Error) {
 	err := os.MkdirAll(tlsconfdir, 0751)
 	if err != nil {
-		log.Exitf("Couldn't create directory %s: %s", tlsconfdir, err.String())
+		return nil, os.NewError(fmt.Sprintf("Couldn't create directory %s: %s", tlsconfdir, err.String()))
 	}
 	confexist := false
 	if s, err := os.Stat(certfile); err == nil && s.IsRegular() {
@@ -111,6 +136,12 @@ func CustomTlsConf() (*tls.Config, os.Error) {
 }
 
 func (n *Network) Connect() os.Error {
+	return n.connect(false)
+}
+
+//connect connects and registers, upgraded tells we already reconnected once
+//because of an sts policy
+func (n *Network) connect(upgraded bool) os.Error {
 	if !n.Disconnected {
 		return nil
 	}
@@ -118,170 +149,234 @@ func (n *Network) Connect() os.Error {
 	for _, ok := <-n.queueOut; ok; _, ok = <-n.queueOut { //empty the write channel so we don't send out-of-context messages
 		continue
 	}
-	if n.user == "" || n.nick == "" || n.realname == "" {
+	if n.user == "" || n.GetPreferredNick() == "" || n.realname == "" {
 		return os.NewError("Empty nick and/or user and/or real name")
 	}
-	tlsConfig, err := CustomTlsConf()
-	if err == nil {
-		n.conn, err = tls.Dial("tcp", "", strings.Join([]string{n.network, n.port}, ":"), tlsConfig)
-	}
+	n.conn, err = n.dial()
 	if err != nil {
-		n.l.Println("Problem connecting using tls, trying plain-text")
-		n.conn, err = net.Dial("tcp", "", strings.Join([]string{n.network, n.port}, ":"))
-		if err != nil {
-			return os.NewError(fmt.Sprintf("Couldn't connect to network %s: %s.\n", n.network, err.String()))
-		}
+		return os.NewError(fmt.Sprintf("Couldn't connect to network %s: %s.\n", n.network, err.String()))
 	}
-	n.buf = bufio.NewReadWriter(bufio.NewReader(n.conn), bufio.NewWriter(n.conn))
 	n.server = n.conn.RemoteAddr().String()
+	n.localaddr = n.conn.LocalAddr().String()
 	n.Disconnected = false
 	n.l.Printf("Connected to network %s, server %s\n", n.network, n.server)
-	go n.receiver()
-	go n.sender()
-	go n.pinger()
-	go n.ponger()
-	go n.ctcp()
+	conn := n.conn
+	n.spawn("receiver", func(n *Network, quit chan bool) { n.receiver(conn, quit) })
+	n.spawn("sender", func(n *Network, quit chan bool) { n.sender(conn, quit) })
+	n.spawn("correlator", (*Network).correlate)
+	n.spawn("batcher", (*Network).batcher)
+	n.spawn("pinger", (*Network).pinger)
+	n.spawn("ponger", func(n *Network, quit chan bool) { n.ponger(conn, quit) })
+	n.spawn("ctcp", (*Network).ctcp)
+	n.spawn("capper", (*Network).capper)
+	n.spawn("isupporter", (*Network).isupporter)
+	n.spawn("nicker", (*Network).nicker)
+	n.spawn("regainer", (*Network).regainer)
+	n.spawn("registrar", (*Network).registrar)
+	n.spawn("serviceser", (*Network).serviceser)
 	err = n.Register()
+	if err == errStsUpgrade && !upgraded {
+		n.l.Printf("Server requires tls, reconnecting to port %s", n.stsport)
+		n.drop(conn, "Upgrading to tls")
+		return n.connect(true)
+	} else if err == errStsUpgrade {
+		n.drop(conn, "Insecure connection after upgrading to tls")
+		return os.NewError(fmt.Sprintf("Couldn't upgrade to tls on network %s", n.network))
+	}
 	if err != nil {
 		n.Disconnect("Error during connection")
 		return os.NewError(fmt.Sprintf("Couldn't register to network %s: %s.\n", n.network, err.String()))
 	}
+	if !n.waitMotd() {
+		n.l.Printf("No end of motd from network %s", n.network)
+	}
 	n.Ping()
-	n.l.Printf("Network lag is: %d nanoseconds", n.lag)
+	n.l.Printf("Network lag is: %s", n.Lag())
 	return nil
 }
 
 func (n *Network) Reconnect(reason string) os.Error {
 	n.l.Printf("Connecting to irc network %s.\n", n.network)
 	if !n.Disconnected {
-		n.Disconnect(reason)
+		if err := n.Disconnect(reason); err != nil {
+			n.l.Printf("Error during disconnect: %s", err.String())
+		}
 	}
 	return n.Connect()
 }
 
-func (n *Network) Disconnect(reason string) {
+//Disconnect sends a QUIT, waits until it has been written to the server and
+//stops the goroutines serving the connection. The returned error describes
+//what couldn't be flushed or stopped before the shutdown timeout.
+func (n *Network) Disconnect(reason string) os.Error {
+	return n.disconnect(nil, reason, true)
+}
+
+//drop tears down a broken connection without trying to send a QUIT. Nothing
+//is done if conn isn't the current connection anymore, we already reconnected;
+//nil is whatever connection we have.
+func (n *Network) drop(conn transport, reason string) {
+	if err := n.disconnect(conn, reason, false); err != nil {
+		n.l.Printf("Error during disconnect (%s): %s", reason, err.String())
+	}
+}
+
+func (n *Network) disconnect(conn transport, reason string, quit bool) os.Error {
+	n.connLock.Lock()
+	defer n.connLock.Unlock()
+	if conn != nil && conn != n.conn {
+		return nil
+	}
+	var err os.Error
 	if n.conn != nil {
-		n.Quit(reason)
-		time.Sleep(timeout(n.lag)) //FIXME: sleep 1 second to send QUIT message
-		if rem := n.Shutdown.do(); rem != 0 {
-			if rem := n.Shutdown.do(); rem != 0 {
-				os.Exit(1)
+		if quit {
+			err = n.quitAndFlush(reason)
+		}
+		if serr := n.Shutdown.do(n.shutdownTimeout); serr != nil {
+			if err != nil {
+				err = os.NewError(fmt.Sprintf("%s, %s", err.String(), serr.String()))
+			} else {
+				err = serr
 			}
 		}
 		n.conn.Close()
+		n.conn = nil
 	}
 	n.Disconnected = true
-	n.lag = second * 3
-	return
+	n.lags.reset()
+	n.caps.reset()
+	n.isupport.reset()
+	n.reg.reset()
+	n.services.setIdentified(false)
+	n.correlator.reset()
+	n.nickLock.Lock()
+	n.welcomed = false
+	n.nickLock.Unlock()
+	n.batches.reset()
+	n.account = ""
+	return err
 }
 
-func (n *Network) sender() {
-	exch := make(chan bool, 10)
-	err := n.Shutdown.Reg(exch)
+//quitAndFlush queues a QUIT and waits until the sender has flushed it to the
+//connection.
+func (n *Network) quitAndFlush(reason string) os.Error {
+	ch := make(chan *IrcMessage, 1)
+	sub, err := n.OutListen.RegListener([]string{"QUIT"}, ch)
 	if err != nil {
-		return
+		return os.NewError(fmt.Sprintf("Couldn't register listener for QUIT: %s", err.String()))
+	}
+	defer sub.Close()
+	ticker := time.NewTicker(n.timeout())
+	defer ticker.Stop()
+	if err := n.Quit(reason); err != nil {
+		return os.NewError(fmt.Sprintf("Couldn't send QUIT: %s", err.String()))
 	}
+	select {
+	case <-ch:
+	case <-ticker.C:
+		return os.NewError("Timeout while flushing QUIT message")
+	}
+	return nil
+}
+
+//spawn starts f as a goroutine serving the current connection, registered
+//with the shutdown dispatcher under name.
+func (n *Network) spawn(name string, f func(*Network, chan bool)) {
+	quit, done := n.Shutdown.Reg(name)
+	go func() {
+		defer close(done)
+		f(n, quit)
+	}()
+}
+
+//sender writes the queued messages to conn
+func (n *Network) sender(conn transport, quit chan bool) {
 	for {
 		var msg *IrcMessage
 		select {
 		case msg = <-n.queueOut:
-		case exit := <-exch:
-			if exit {
-				return
-			}
-			continue
-		}
-		if n.conn == nil || n.buf == nil {
-			n.l.Printf("Error writing message (%s): No connection", msg)
-			n.Disconnect("Connection error")
+		case <-quit:
 			return
 		}
-		_, err = n.buf.WriteString(fmt.Sprintf("%s\r\n", msg.String()))
-		if err != nil {
-			n.l.Printf("Error writing to socket (%s): %s", err.String(), msg)
-			n.Disconnect("Connection error")
-			return
+		msgs, verdict := n.interceptors.run(msg)
+		if verdict != nil {
+			n.l.Printf("Not sending: %s", verdict.String())
 		}
-		err = n.buf.Flush()
-		if err != nil {
-			n.l.Printf("Error flushing socket (%s): %s", err.String(), msg)
-			n.Disconnect("Connection error")
-			return
+		for _, m := range msgs {
+			if err := conn.WriteLine(m.String()); err != nil {
+				n.l.Printf("Error writing to socket (%s): %s", err.String(), m)
+				n.interceptors.verdict(msg, err)
+				go n.drop(conn, "Connection error")
+				return
+			}
+			n.OutListen.dispatch(*m)
 		}
-		go n.OutListen.dispatch(*msg)
+		n.interceptors.verdict(msg, verdict)
 	}
 	return
 }
 
-func (n *Network) receiver() {
-	exch := make(chan bool, 10)
-	err := n.Shutdown.Reg(exch)
-	if err != nil {
-		return
-	}
+//receiver reads the messages from conn and dispatches them
+func (n *Network) receiver(conn transport, quit chan bool) {
 	for {
-		if n.buf == nil {
-			n.Disconnect("Connection error")
-			return
-		}
-		retch := make(chan string)
-		errch := make(chan os.Error)
-		go func(ch chan string, errch chan os.Error) {
-			l, err := n.buf.ReadString('\n')
+		//buffered so the reader never blocks once we stopped listening
+		retch := make(chan string, 1)
+		errch := make(chan os.Error, 1)
+		go func(conn transport, ch chan string, errch chan os.Error) {
+			l, err := conn.ReadLine()
 			if err != nil {
-				if !closed(errch) {
-					errch <- err
-				}
+				errch <- err
 			} else {
-				if !closed(ch) {
-					ch <- l
-				}
+				ch <- l
 			}
-		}(retch, errch)
+		}(conn, retch, errch)
 		var l string
 		select {
-		case exit := <-exch:
-			if exit {
-				return
-			}
-			continue
+		case <-quit:
+			return
 		case err := <-errch:
 			n.l.Println("Can't read: socket: ", err.String())
-			n.Disconnect("Connection error")
+			go n.drop(conn, "Connection error")
 			return
 		case l = <-retch:
 		}
-		l = strings.TrimRight(l, "\r\n")
 		msg, err := PackMsg(l)
 		if err != nil {
 			n.l.Printf("Couldn't unpack message: %s: %s", err.String(), l)
 			continue
 		}
-		//dispatch
-		go n.Listen.dispatch(msg)
+		//dispatch in order, listeners are fed by their own goroutines
+		n.Listen.dispatch(msg)
 	}
 	return
 }
 
 func NewNetwork(net, port, nick, usr, rn, pass, logfp string) *Network {
 	n := new(Network)
-	err := os.MkdirAll(confdir, 0751)
-	if err != nil {
-		log.Exitf("Couldn't create directory %s: %s", confdir, err.String())
-	}
 	n.network = net
 	n.port = port
 	n.password = pass
 	n.nick = nick
+	n.prefnick = nick
+	n.nickLock = new(sync.Mutex)
+	n.nicklisteners = newNotifier()
+	n.altnick = AltNickSuffix(9)
 	n.user = usr
 	n.realname = rn
-	n.Listen = dispatchMap{new(sync.RWMutex), make(map[string]map[string]chan *IrcMessage)}
-	n.OutListen = dispatchMap{new(sync.RWMutex), make(map[string]map[string]chan *IrcMessage)}
-	n.Shutdown = shutdownDispatcher{new(sync.Mutex), make([]chan bool, 0)}
+	n.Shutdown = shutdownDispatcher{new(sync.Mutex), make(chan bool), make([]shutdownClient, 0)}
 	n.queueOut = make(chan *IrcMessage, 100)
 	n.conn = nil
-	n.buf = nil
-	n.lag = second // initial lag of 1 second for all irc commands (a lot)
+	n.connLock = new(sync.Mutex)
+	n.wsprotocol = WSTEXT
+	n.lags = newLagTracker()
+	n.caps = newCapSet()
+	n.isupport = newISupportTracker()
+	n.reg = newRegTracker()
+	n.services = newServicesState()
+	n.correlator = newCorrelator()
+	n.batches = newBatchTracker()
+	n.interceptors = newInterceptorChain()
+	n.shutdownTimeout = second * 5
 	n.Disconnected = true
 	logflags := log.Ldate | log.Lmicroseconds | log.Llongfile
 	logprefix := fmt.Sprintf("%s ", n.network)
@@ -296,6 +391,11 @@ func NewNetwork(net, port, nick, usr, rn, pass, logfp string) *Network {
 			n.l = log.New(f, logprefix, logflags)
 		}
 	}
+	n.Listen = newDispatchMap(n.l)
+	n.OutListen = newDispatchMap(n.l)
+	if err := os.MkdirAll(confdir, 0751); err != nil {
+		n.l.Printf("Couldn't create directory %s: %s\n", confdir, err.String())
+	}
 	go n.logger()
 	return n
 }
@@ -62,8 +62,11 @@ func privmsgStressTests(t *testing.T, n *Network, tchs []string) {
 	msgparamfmt := fmt.Sprintf("%s %s", nick, msgfmt)
 	testfunc := func(dch chan bool, n *Network, tchs []string, i int) {
 		ch := make(chan *IrcMessage, parallel+10)
-		if err := n.Listen.RegListener("PRIVMSG", fmt.Sprintf("testprivmsg%d", i), ch); err != nil {
-			t.Errorf("Register error: tried to register cmd %s, name: %s got error %s", "PRIVMSG", fmt.Sprintf("testprivmsg%d", i), err.String())
+		sub, err := n.Listen.RegListener([]string{"PRIVMSG"}, ch)
+		if err != nil {
+			t.Errorf("Register error: tried to register cmd %s, test %d got error %s", "PRIVMSG", i, err.String())
+			dch <- true
+			return
 		}
 		go n.Privmsg([]string{nick}, fmt.Sprintf(msgfmt, i))
 		timeout := time.NewTicker(minute / 2)
@@ -71,9 +74,9 @@ func privmsgStressTests(t *testing.T, n *Network, tchs []string) {
 			select {
 			case msg := <-ch:
 				if strings.Join(msg.Params, " ") == fmt.Sprintf(msgparamfmt, i) {
-					err := n.Listen.DelListener("PRIVMSG", fmt.Sprintf("testprivmsg%d", i))
+					err := sub.Close()
 					if err != nil {
-						t.Errorf("Register error: tried to unregister cmd %s, name: %s got error %s", "PRIVMSG", fmt.Sprintf("testprivmsg%d", i), err.String())
+						t.Errorf("Register error: tried to unregister cmd %s, subscription %d got error %s", "PRIVMSG", sub.ID, err.String())
 					}
 					dch <- true
 					timeout.Stop()
@@ -81,9 +84,9 @@ func privmsgStressTests(t *testing.T, n *Network, tchs []string) {
 				}
 			case <-timeout.C:
 				t.Errorf("Stress-test error: didn't receive sent message: %d", i)
-				err := n.Listen.DelListener("PRIVMSG", fmt.Sprintf("testprivmsg%d", i))
+				err := sub.Close()
 				if err != nil {
-					t.Errorf("Register error: tried to unregister cmd %s, name: %s got error %s", "PRIVMSG", fmt.Sprintf("testprivmsg%d", i), err.String())
+					t.Errorf("Register error: tried to unregister cmd %s, subscription %d got error %s", "PRIVMSG", sub.ID, err.String())
 				}
 				timeout.Stop()
 				dch <- true
@@ -124,42 +124,70 @@ var replies = map[string]string{
 	"RPL_LUSERCHANNELS":    "254",
 	"RPL_LUSERME":          "255",
 	"RPL_ADMINME":          "256",
-	"RPL_ADMINEMAIL":       "259"}
-
-func timeout(lag int64) int64 {
-	t := lag * 3
-	if t > second*15 {
-		return second * 15
+	"RPL_ADMINEMAIL":       "259",
+	"RPL_WELCOME":          "001",
+	"RPL_YOURHOST":         "002",
+	"RPL_CREATED":          "003",
+	"RPL_MYINFO":           "004",
+	"RPL_ISUPPORT":         "005",
+	"RPL_MONONLINE":        "730",
+	"RPL_MONOFFLINE":       "731",
+	"RPL_MONLIST":          "732",
+	"RPL_ENDOFMONLIST":     "733",
+	"ERR_MONLISTFULL":      "734",
+	"RPL_LOGGEDIN":         "900",
+	"RPL_LOGGEDOUT":        "901",
+	"ERR_NICKLOCKED":       "902",
+	"RPL_SASLSUCCESS":      "903",
+	"ERR_SASLFAIL":         "904",
+	"ERR_SASLTOOLONG":      "905",
+	"ERR_SASLABORTED":      "906",
+	"ERR_SASLALREADY":      "907",
+	"RPL_SASLMECHS":        "908"}
+
+//replyCodes maps reply names to their numerics, commands are kept as is
+func replyCodes(names ...string) []string {
+	ret := make([]string, len(names))
+	for i, name := range names {
+		if code, ok := replies[name]; ok {
+			ret[i] = code
+		} else {
+			ret[i] = name
+		}
 	}
-	return t
+	return ret
 }
 
 func (n *Network) Register() os.Error {
-	var err os.Error
 	welcome := make(chan *IrcMessage, 1)
-	if err = n.Listen.RegListener("001", "register", welcome); err != nil {
+	sub, err := n.Listen.RegListener([]string{"001"}, welcome)
+	if err != nil {
 		return os.NewError("Couldn't register listener for welcome messages (001)")
 	}
-	defer n.Listen.DelListener("001", "register")
+	defer sub.Close()
+	n.Webirc()
 	if n.password != "" {
 		err = n.Pass()
 		if err != nil {
 			return os.NewError("Couldn't register with password")
 		}
 	}
+	if err = n.negotiateCaps(); err != nil {
+		return err
+	}
 	nret := make(chan bool, 1)
 	go func(n *Network, ret chan bool) {
-		_, err = n.Nick(n.nick)
-		i := 0
-		for err != nil {
-			if i > 8 {
+		pref := n.GetPreferredNick()
+		nick, err := n.nickCmd(pref)
+		for i := 1; err != nil; i++ {
+			alt := n.altnick(pref, i, n.isupport.get())
+			if alt == "" {
 				ret <- false
 				return
 			}
-			n.nick = fmt.Sprintf("_%s", n.nick)
-			_, err = n.Nick(n.nick)
-			i++
+			nick, err = n.nickCmd(alt)
 		}
+		n.guessNick(nick) //until the welcome message tells us what the server made of it
 		ret <- true
 		return
 	}(n, nret)
@@ -180,26 +208,17 @@ func (n *Network) Register() os.Error {
 }
 
 func (n *Network) Pass() os.Error {
-	t := strconv.Itoa64(time.Nanoseconds())
 	myreplies := []string{"ERR_NEEDMOREPARAMS", "ERR_ALREADYREGISTRED"}
-	var err os.Error
-	repch := make(chan *IrcMessage)
-	for _, rep := range myreplies {
-		if err := n.Listen.RegListener(replies[rep], t, repch); err != nil {
-			err = os.NewError(fmt.Sprintf("Couldn't authenticate with password, exiting: %s", err.String()))
-		}
+	q := n.newQuery(myreplies, nil, nil, false)
+	err := n.send(&IrcMessage{"", "PASS", []string{n.password}, nil}, q)
+	if err != nil {
+		return os.NewError(fmt.Sprintf("Couldn't authenticate with password, exiting: %s", err.String()))
 	}
-	ticker := time.NewTicker(timeout(n.lag))
-	defer func(myreplies []string, t string, tick *time.Ticker) {
-		for _, rep := range myreplies {
-			n.Listen.DelListener(replies[rep], t)
-		}
-		tick.Stop()
-		return
-	}(myreplies, t, ticker)
-	n.queueOut <- &IrcMessage{"", "PASS", []string{n.password}}
+	defer n.finish(q)
+	ticker := time.NewTicker(n.timeout())
+	defer ticker.Stop()
 	select {
-	case msg := <-repch:
+	case msg := <-q.out:
 		if msg.Cmd == replies["ERR_NEEDMOREPARAMS"] {
 			err = os.NewError(fmt.Sprintf("Need more parameters for password: %s", msg.String()))
 		}
@@ -210,54 +229,57 @@ func (n *Network) Pass() os.Error {
 	return err
 }
 
-
-func (n *Network) GetNick() string {
-	return n.nick
+//Nick changes our nick and makes it the preferred one, tried first when
+//registering. The current nick (GetNick) changes once the server confirms.
+func (n *Network) Nick(newnick string) (string, os.Error) {
+	if newnick == "" {
+		return n.GetNick(), os.NewError("Empty nicknames are not accepted in IRC")
+	}
+	n.nickLock.Lock()
+	n.prefnick = newnick
+	n.nickLock.Unlock()
+	if n.Disconnected {
+		n.setNick(newnick)
+		return newnick, nil
+	}
+	sent, err := n.nickCmd(newnick)
+	if err != nil {
+		return n.GetNick(), err
+	}
+	return sent, nil
 }
 
-func (n *Network) Nick(newnick string) (string, os.Error) {
-	t := strconv.Itoa64(time.Nanoseconds())
-	ticker := time.NewTicker(timeout(n.lag))
+//nickCmd sends NICK and waits for an error reply, it returns the nick sent
+func (n *Network) nickCmd(newnick string) (string, os.Error) {
+	ticker := time.NewTicker(n.timeout())
 	defer ticker.Stop()
 	myreplies := []string{"ERR_NONICKNAMEGIVEN", "ERR_ERRONEUSNICKNAME", "ERR_NICKNAMEINUSE", "ERR_NICKCOLLISION"}
 	if newnick == "" {
-		return n.nick, os.NewError("Empty nicknames are not accepted in IRC")
+		return newnick, os.NewError("Empty nicknames are not accepted in IRC")
 	}
 	//TODO: check for correct nick (illegal characters)
-	if len(newnick) > 9 {
-		newnick = newnick[:9]
+	if l := n.isupport.get().NickLen; l > 0 && len(newnick) > l {
+		newnick = newnick[:l]
 	}
-	repch := make(chan *IrcMessage)
-	defer func(myreplies []string, t string) {
-		for _, rep := range myreplies {
-			n.Listen.DelListener(replies[rep], t)
-		}
-		return
-	}(myreplies, t)
-	for _, rep := range myreplies {
-		if err := n.Listen.RegListener(replies[rep], t, repch); err != nil {
-			for _, rep := range myreplies {
-				n.Listen.DelListener(replies[rep], t)
-			}
-			return n.nick, os.NewError("Unable to register new listener")
-		}
+	q := n.newQuery(myreplies, nil, []string{newnick}, false)
+	if err := n.send(&IrcMessage{"", "NICK", []string{newnick}, nil}, q); err != nil {
+		return newnick, err
 	}
-	n.queueOut <- &IrcMessage{"", "NICK", []string{newnick}}
+	defer n.finish(q)
 	select {
-	case msg := <-repch:
+	case msg := <-q.out:
 		if msg.Cmd == replies["ERR_ERRONEUSNICKNAME"] || msg.Cmd == replies["ERR_NICKNAMEINUSE"] || msg.Cmd == replies["ERR_NICKCOLLISION"] {
 			for key, _ := range replies {
 				if replies[key] == msg.Cmd {
-					return n.nick, os.NewError(key)
+					return newnick, os.NewError(key)
 				}
 			}
-			return n.nick, os.NewError("Unknown error")
+			return newnick, os.NewError("Unknown error")
 		}
 	case <-ticker.C:
 		break
 	}
-	n.nick = newnick
-	return n.nick, nil
+	return newnick, nil
 }
 
 func (n *Network) GetUser(newuser string) string {
@@ -265,30 +287,21 @@ func (n *Network) GetUser(newuser string) string {
 }
 
 func (n *Network) User(newuser string) (string, os.Error) {
-	t := strconv.Itoa64(time.Nanoseconds())
-	ticker := time.NewTicker(timeout(n.lag))
+	ticker := time.NewTicker(n.timeout())
 	defer ticker.Stop()
 	myreplies := []string{"ERR_NEEDMOREPARAMS", "ERR_ALREADYREGISTRED", "RPL_ENDOFMOTD", "ERR_NOTREGISTERED"}
 	if newuser == "" {
 		return n.user, os.NewError("Can't have an empty user field")
-	} else if len(newuser) > 9 {
-		newuser = newuser[:9]
+	} else if l := n.isupport.get().UserLen; l > 0 && len(newuser) > l {
+		newuser = newuser[:l]
 	}
-	repch := make(chan *IrcMessage)
-	defer func(myreplies []string, t string) {
-		for _, rep := range myreplies {
-			n.Listen.DelListener(replies[rep], t)
-		}
-		return
-	}(myreplies, t)
-	for _, rep := range myreplies {
-		if err := n.Listen.RegListener(replies[rep], t, repch); err != nil {
-			return "", os.NewError(fmt.Sprintf("Couldn't register Listener for %s: %s", replies[rep], err.String()))
-		}
+	q := n.newQuery(myreplies, nil, nil, false)
+	if err := n.send(&IrcMessage{"", "USER", []string{n.user, "0.0.0.0", "0.0.0.0", n.realname}, nil}, q); err != nil {
+		return "", err
 	}
-	n.queueOut <- &IrcMessage{"", "USER", []string{n.user, "0.0.0.0", "0.0.0.0", n.realname}}
+	defer n.finish(q)
 	select {
-	case msg := <-repch:
+	case msg := <-q.out:
 		if msg.Cmd == replies["ERR_NEEDMOREPARAMS"] {
 			return n.user, os.NewError("ERR_NEEDMOREPARAMS")
 		} else if msg.Cmd == replies["ERR_ALREADYREGISTRED"] {
@@ -327,70 +340,58 @@ func (n *Network) NetName(newname string, reason string) (string, os.Error) {
 	return n.network, nil //BUG: why do we need this?
 }
 
-func (n *Network) SysOpMe(user, pass string) {
-	n.queueOut <- &IrcMessage{"", "OPER", []string{user, pass}}
+func (n *Network) SysOpMe(user, pass string) os.Error {
+	if err := n.Send(&IrcMessage{"", "OPER", []string{user, pass}, nil}); err != nil {
+		return err
+	}
 	//TODO: replies:
 	//ERR_NEEDMOREPARAMS              RPL_YOUREOPER
 	//ERR_NOOPERHOST                  ERR_PASSWDMISMATCH
-	return
+	return nil
 }
 
-func (n *Network) Quit(reason string) {
-	n.queueOut <- &IrcMessage{"", "QUIT", []string{reason}}
-	return
+func (n *Network) Quit(reason string) os.Error {
+	return n.Send(&IrcMessage{"", "QUIT", []string{reason}, nil})
 }
 
 func (n *Network) Join(chans []string, keys []string) os.Error { //return: topic, list?
 	if len(chans) == 0 {
 		return os.NewError("No channels given")
 	}
-	t := strconv.Itoa64(time.Nanoseconds())
-	ticker := time.NewTicker(timeout(n.lag))
+	ticker := time.NewTicker(n.timeout())
 	myreplies := []string{"ERR_NEEDMOREPARAMS", "ERR_BANNEDFROMCHAN",
 		"ERR_INVITEONLYCHAN", "ERR_BADCHANNELKEY",
 		"ERR_CHANNELISFULL", "ERR_BADCHANMASK",
 		"ERR_NOSUCHCHANNEL", "ERR_TOOMANYCHANNELS",
 		"RPL_TOPIC", "JOIN"}
+	isupport := n.isupport.get()
 	for _, ch := range chans {
-		if !strings.HasPrefix(ch, "#") && !strings.HasPrefix(ch, "&") && !strings.HasPrefix(ch, "+") && !strings.HasPrefix(ch, "!") {
+		if !isupport.IsChannel(ch) {
 			return os.NewError(fmt.Sprintf("Channel %s doesn't start with a legal prefix", ch))
 		}
+		if isupport.ChannelLen > 0 && len(ch) > isupport.ChannelLen {
+			return os.NewError(fmt.Sprintf("Channel %s is longer than %d characters", ch, isupport.ChannelLen))
+		}
 		if strings.Contains(ch, string(' ')) || strings.Contains(ch, string(7)) || strings.Contains(ch, ",") {
 			return os.NewError(fmt.Sprintf("Channel %s contains illegal characters", ch))
 		}
 	}
-	repch := make(chan *IrcMessage, 10)
-	defer func(myreplies []string, t string) {
-		for _, rep := range myreplies {
-			_, ok := replies[rep]
-			if ok {
-				n.Listen.DelListener(replies[rep], t)
-			} else {
-				n.Listen.DelListener(rep, t)
-			}
-		}
-		return
-	}(myreplies, t)
-	for _, rep := range myreplies {
-		_, ok := replies[rep]
-		if ok {
-			if err := n.Listen.RegListener(replies[rep], t, repch); err != nil {
-				return os.NewError(fmt.Sprintf("Couldn't register listener %s: %s", replies[rep], err.String()))
-			}
-		} else {
-			if err := n.Listen.RegListener(rep, t, repch); err != nil {
-				return os.NewError(fmt.Sprintf("Couldn't register listener %s: %s", rep, err.String()))
-			}
-		}
+	q := n.newQuery(myreplies, nil, chans, true)
+	q.match = func(msg *IrcMessage) bool { //other users join too
+		return msg.Cmd != "JOIN" || n.isMe(msg.Prefix)
+	}
+	if err := n.send(&IrcMessage{"", "JOIN", []string{strings.Join(chans, ","), strings.Join(keys, ",")}, nil}, q); err != nil {
+		ticker.Stop()
+		return err
 	}
-	n.queueOut <- &IrcMessage{"", "JOIN", []string{strings.Join(chans, ","), strings.Join(keys, ",")}}
+	defer n.finish(q)
 	joined := 0
 	for {
 		select {
-		case msg := <-repch:
-			if msg.Cmd == "JOIN" {
+		case msg := <-q.out:
+			if msg.Cmd == "JOIN" && len(msg.Params) > 0 {
 				for _, chn := range chans {
-					if msg.Params[0] == chn {
+					if isupport.Fold(msg.Params[0]) == isupport.Fold(chn) {
 						joined++
 						break
 					}
@@ -410,7 +411,7 @@ func (n *Network) Join(chans []string, keys []string) os.Error { //return: topic
 				return nil
 			}
 			ticker.Stop()
-			ticker = time.NewTicker(timeout(n.lag))
+			ticker = time.NewTicker(n.timeout())
 		case <-ticker.C:
 			ticker.Stop()
 			return os.NewError("Didn't receive join reply")
@@ -420,46 +421,33 @@ func (n *Network) Join(chans []string, keys []string) os.Error { //return: topic
 	return nil
 }
 
-func (n *Network) Part(chans []string, reason string) {
-	n.queueOut <- &IrcMessage{"", "PART", []string{strings.Join(chans, ","), reason}}
+func (n *Network) Part(chans []string, reason string) os.Error {
+	if err := n.Send(&IrcMessage{"", "PART", []string{strings.Join(chans, ","), reason}, nil}); err != nil {
+		return err
+	}
 	//TODO: replies:
 	//ERR_NEEDMOREPARAMS              ERR_NOSUCHCHANNEL
 	//ERR_NOTONCHANNEL
-	return
-}
-
-func (n *Network) Mode(target, mode, params string) {
-	chmodes := []byte{'o', 'p', 's', 'i', 't', 'n', 'm', 'l', 'b', 'v', 'k'}
-	usrmodes := []byte{'i', 's', 'w', 'o'}
-	var found bool
-	for _, c := range mode { //is it a channel mode?
-		found = false
-		for _, m := range chmodes {
-			if m == byte(c) {
-				found = true
-				break
-			}
+	return nil
+}
+
+func (n *Network) Mode(target, mode, params string) os.Error {
+	isupport := n.isupport.get()
+	modes := "iswo" //user modes
+	if isupport.IsChannel(target) {
+		modes = isupport.PrefixModes + strings.Join(isupport.ChanModes[:], "")
+	}
+	for _, c := range mode {
+		if c == '+' || c == '-' {
+			continue
 		}
-		if !found {
-			break
+		if strings.IndexRune(modes, c) < 0 { //not a mode of this target, don't touch this
+			return os.NewError(fmt.Sprintf("Mode %c doesn't apply to %s", c, target))
 		}
 	}
-	if !found { //maybe it's a user mode?
-		for _, c := range mode {
-			found := false
-			for _, m := range usrmodes {
-				if m == byte(c) {
-					found = true
-					break
-				}
-			}
-			if !found { //neither a channel nor a user mode, don't touch this
-				return
-				//TODO: return error?
-			}
-		}
+	if err := n.Send(&IrcMessage{"", "MODE", []string{target, mode, params}, nil}); err != nil {
+		return err
 	}
-	n.queueOut <- &IrcMessage{"", "MODE", []string{target, mode, params}}
 	//TODO: replies:
 	//ERR_NEEDMOREPARAMS              RPL_CHANNELMODEIS
 	//ERR_CHANOPRIVSNEEDED            ERR_NOSUCHNICK
@@ -469,20 +457,22 @@ func (n *Network) Mode(target, mode, params string) {
 	//
 	//ERR_USERSDONTMATCH              RPL_UMODEIS
 	//ERR_UMODEUNKNOWNFLAG
-	return
+	return nil
 }
 
-func (n *Network) SetTopic(ch, topic string) {
-	n.queueOut <- &IrcMessage{"", "TOPIC", []string{ch, topic}}
+func (n *Network) SetTopic(ch, topic string) os.Error {
+	if err := n.Send(&IrcMessage{"", "TOPIC", []string{ch, topic}, nil}); err != nil {
+		return err
+	}
 	//TODO: replies
 	//ERR_NEEDMOREPARAMS              ERR_NOTONCHANNEL
 	//RPL_NOTOPIC                     RPL_TOPIC
 	//ERR_CHANOPRIVSNEEDED
-	return
+	return nil
 }
 
 func (n *Network) GetTopic(ch string) string {
-	n.queueOut <- &IrcMessage{"", "TOPIC", []string{ch}}
+	n.Send(&IrcMessage{"", "TOPIC", []string{ch}, nil}) //TODO: return the error with the topic
 	//TODO: replies
 	//ERR_NEEDMOREPARAMS              ERR_NOTONCHANNEL
 	//RPL_NOTOPIC                     RPL_TOPIC
@@ -490,70 +480,73 @@ func (n *Network) GetTopic(ch string) string {
 	return ""
 }
 
-func (n *Network) Names(chans []string) {
-	n.queueOut <- &IrcMessage{"", "NAMES", []string{strings.Join(chans, ",")}}
+func (n *Network) Names(chans []string) os.Error {
+	if err := n.Send(&IrcMessage{"", "NAMES", []string{strings.Join(chans, ",")}, nil}); err != nil {
+		return err
+	}
 	//TODO: replies:
 	//RPL_NAMREPLY                    RPL_ENDOFNAMES
-	return
+	return nil
 }
 
-func (n *Network) List(chans []string, server string) {
-	msg := &IrcMessage{"", "LIST", []string{}}
+func (n *Network) List(chans []string, server string) os.Error {
+	msg := &IrcMessage{"", "LIST", []string{}, nil}
 	if len(chans) > 0 {
 		msg.Params = append(msg.Params, strings.Join(chans, ","))
 	}
 	if server != "" {
 		msg.Params = append(msg.Params, server)
 	}
-	n.queueOut <- msg
+	if err := n.Send(msg); err != nil {
+		return err
+	}
 	//TODO: replies:
 	//ERR_NOSUCHSERVER                RPL_LISTSTART
 	//RPL_LIST                        RPL_LISTEND
-	return
+	return nil
 }
 
-func (n *Network) Invite(target, ch string) {
-	n.queueOut <- &IrcMessage{"", "INVITE", []string{target, ch}}
+func (n *Network) Invite(target, ch string) os.Error {
+	if err := n.Send(&IrcMessage{"", "INVITE", []string{target, ch}, nil}); err != nil {
+		return err
+	}
 	//TODO: replies:
 	//ERR_NEEDMOREPARAMS              ERR_NOSUCHNICK
 	//ERR_NOTONCHANNEL                ERR_USERONCHANNEL
 	//ERR_CHANOPRIVSNEEDED
 	//RPL_INVITING                    RPL_AWAY
-	return
+	return nil
 }
 
-func (n *Network) Kick(ch, target, reason string) {
-	n.queueOut <- &IrcMessage{"", "KICK", []string{ch, target, reason}}
+func (n *Network) Kick(ch, target, reason string) os.Error {
+	if err := n.Send(&IrcMessage{"", "KICK", []string{ch, target, reason}, nil}); err != nil {
+		return err
+	}
 	//TODO: replies:
 	//ERR_NEEDMOREPARAMS              ERR_NOSUCHCHANNEL
 	//ERR_BADCHANMASK                 ERR_CHANOPRIVSNEEDED
 	//ERR_NOTONCHANNEL
-	return
+	return nil
 }
 
 func (n *Network) Privmsg(target []string, msg string) os.Error { //BUG: make privmsg hack up messages that are too long
-	t := strconv.Itoa64(time.Nanoseconds())
-	ticker := time.NewTicker(timeout(n.lag))
+	if max := n.isupport.get().TargMax["PRIVMSG"]; max > 0 && len(target) > max {
+		return os.NewError("ERR_TOOMANYTARGETS")
+	}
+	ticker := time.NewTicker(n.timeout())
 	myreplies := []string{"ERR_NORECIPIENT", "ERR_NOTEXTTOSEND",
 		"ERR_CANNOTSENDTOCHAN", "ERR_NOTOPLEVEL",
 		"ERR_WILDTOPLEVEL", "ERR_TOOMANYTARGETS",
 		"ERR_NOSUCHNICK", "RPL_AWAY"}
-	repch := make(chan *IrcMessage, 10)
-	for _, rep := range myreplies {
-		if err := n.Listen.RegListener(replies[rep], t, repch); err != nil {
-			return os.NewError(fmt.Sprintf("Couldn't register nick %s: %s", replies[rep], err.String()))
-		}
+	q := n.newQuery(myreplies, nil, target, false)
+	if err := n.send(&IrcMessage{"", "PRIVMSG", []string{strings.Join(target, ","), msg}, nil}, q); err != nil {
+		ticker.Stop()
+		return err
 	}
-	defer func(myreplies []string, t string) {
-		for _, rep := range myreplies {
-			n.Listen.DelListener(replies[rep], t)
-		}
-		return
-	}(myreplies, t)
-	n.queueOut <- &IrcMessage{"", "PRIVMSG", []string{strings.Join(target, ","), msg}}
+	defer n.finish(q)
 	for {
 		select {
-		case msg := <-repch:
+		case msg := <-q.out:
 			for key, _ := range replies {
 				if replies[key] == msg.Cmd && key[:3] == "ERR" {
 					ticker.Stop()
@@ -561,7 +554,7 @@ func (n *Network) Privmsg(target []string, msg string) os.Error { //BUG: make pr
 				}
 			}
 			ticker.Stop()
-			ticker = time.NewTicker(timeout(n.lag))
+			ticker = time.NewTicker(n.timeout())
 		case <-ticker.C:
 			ticker.Stop()
 			return nil
@@ -571,68 +564,63 @@ func (n *Network) Privmsg(target []string, msg string) os.Error { //BUG: make pr
 	return nil
 }
 
-func (n *Network) Notice(target, text string) { //BUG: make notice hack up messages that are too long
-	n.queueOut <- &IrcMessage{"", "NOTICE", []string{target, text}}
+func (n *Network) Notice(target, text string) os.Error { //BUG: make notice hack up messages that are too long
+	if err := n.Send(&IrcMessage{"", "NOTICE", []string{target, text}, nil}); err != nil {
+		return err
+	}
 	//TODO: replies:
 	//ERR_NORECIPIENT                 ERR_NOTEXTTOSEND
 	//ERR_CANNOTSENDTOCHAN            ERR_NOTOPLEVEL
 	//ERR_WILDTOPLEVEL                ERR_TOOMANYTARGETS
 	//ERR_NOSUCHNICK
 	//RPL_AWAY
-	return
+	return nil
 }
 
-func (n *Network) Who(target string) {
-	n.queueOut <- &IrcMessage{"", "WHO", []string{target}}
+func (n *Network) Who(target string) os.Error {
+	if err := n.Send(&IrcMessage{"", "WHO", []string{target}, nil}); err != nil {
+		return err
+	}
 	//TODO: replies:
 	//ERR_NOSUCHSERVER
 	//RPL_WHOREPLY                    RPL_ENDOFWHO
-	return
+	return nil
 }
 
 func (n *Network) Whois(target []string, server string) (map[string][]string, os.Error) { //TODO: return a map[string][][]string? map[string][]IrcMessage?
-	t := strconv.Itoa64(time.Nanoseconds())
 	ret := make(map[string][]string)
-	ticker := time.NewTicker(timeout(n.lag))
+	ticker := time.NewTicker(n.timeout())
 	myreplies := []string{"ERR_NOSUCHSERVER", "ERR_NONICKNAMEGIVEN",
 		"RPL_WHOISUSER", "RPL_WHOISCHANNELS",
 		"RPL_WHOISSERVER", "RPL_AWAY",
 		"RPL_WHOISOPERATOR", "RPL_WHOISIDLE",
 		"ERR_NOSUCHNICK", "RPL_ENDOFWHOIS"}
-	repch := make(chan *IrcMessage, 10)
-	defer func(myreplies []string, t string) {
-		for _, rep := range myreplies {
-			n.Listen.DelListener(replies[rep], t)
-		}
-		return
-	}(myreplies, t)
-	for _, rep := range myreplies {
-		if err := n.Listen.RegListener(replies[rep], t, repch); err != nil {
-			ticker.Stop()
-			return ret, os.NewError(fmt.Sprintf("Couldn't whois %s=%s: %s", replies[rep], rep, err.String()))
-		}
+	q := n.newQuery(myreplies[:len(myreplies)-1], myreplies[len(myreplies)-1:], target, true)
+	msg := &IrcMessage{"", "WHOIS", []string{strings.Join(target, ",")}, nil}
+	if server != "" {
+		msg.Params = []string{server, strings.Join(target, ",")}
 	}
-
-	if server == "" {
-		n.queueOut <- &IrcMessage{"", "WHOIS", []string{strings.Join(target, ",")}}
-	} else {
-		n.queueOut <- &IrcMessage{"", "WHOIS", []string{server, strings.Join(target, ",")}}
+	err := n.send(msg, q)
+	if err != nil {
+		ticker.Stop()
+		return ret, os.NewError(fmt.Sprintf("Couldn't whois: %s", err.String()))
 	}
+	defer n.finish(q)
+
 	for _, rep := range myreplies {
 		ret[replies[rep]] = make([]string, 0)
 	}
 	done := 0
-	err := os.Error(nil)
 	for {
 		select {
-		case m := <-repch:
+		case m := <-q.out:
 			ret[m.Cmd] = append(ret[m.Cmd], strings.Join((*m).Params, " "))
 			if m.Cmd == replies["RPL_ENDOFWHOIS"] {
 				ticker.Stop()
 				return ret, err
 			} else if m.Cmd == replies["ERR_NOSUCHNICK"] {
 				for _, targ := range target {
-					if m.Params[1] == targ {
+					if len(m.Params) > 1 && m.Params[1] == targ {
 						if err == nil {
 							err = os.NewError(fmt.Sprintf("No such nick: %s", targ))
 						} else {
@@ -646,7 +634,7 @@ func (n *Network) Whois(target []string, server string) (map[string][]string, os
 				}
 			}
 			ticker.Stop()
-			ticker = time.NewTicker(timeout(n.lag)) //restart the ticker to timeout correctly
+			ticker = time.NewTicker(n.timeout()) //restart the ticker to timeout correctly
 		case <-ticker.C:
 			ticker.Stop()
 			return ret, err
@@ -656,8 +644,8 @@ func (n *Network) Whois(target []string, server string) (map[string][]string, os
 	return ret, err //BUG: why do we need this?
 }
 
-func (n *Network) Whowas(target string, count int, server string) {
-	msg := &IrcMessage{"", "WHOIS", []string{}}
+func (n *Network) Whowas(target string, count int, server string) os.Error {
+	msg := &IrcMessage{"", "WHOIS", []string{}, nil}
 	msg.Params = append(msg.Params, target)
 	if count != 0 {
 		msg.Params = append(msg.Params, strconv.Itoa(count))
@@ -665,50 +653,50 @@ func (n *Network) Whowas(target string, count int, server string) {
 	if server != "" {
 		msg.Params = append(msg.Params, server)
 	}
-	n.queueOut <- msg
+	if err := n.Send(msg); err != nil {
+		return err
+	}
 	//TODO: replies:
 	//ERR_NONICKNAMEGIVEN             ERR_WASNOSUCHNICK
 	//RPL_WHOWASUSER                  RPL_WHOISSERVER
 	//RPL_ENDOFWHOWAS
-	return
+	return nil
 }
 
-func (n *Network) PingNick(nick string) {
-	n.queueOut <- &IrcMessage{"", "PING", []string{nick}}
+func (n *Network) PingNick(nick string) os.Error {
+	if err := n.Send(&IrcMessage{"", "PING", []string{nick}, nil}); err != nil {
+		return err
+	}
 	//TODO: replies:
 	//ERR_NOORIGIN                    ERR_NOSUCHSERVER
-	return
+	return nil
 }
 
 func (n *Network) Ping() (int64, os.Error) {
-	myreplies := []string{"ERR_NOORIGIN", "ERR_NOSUCHSERVER"}
-	t := strconv.Itoa64(time.Nanoseconds())
-	repch := make(chan *IrcMessage, 10)
-	ticker := time.NewTicker(timeout(n.lag))
-	defer ticker.Stop()
-	defer func(myreplies []string, t string, n *Network) {
-		for _, rep := range myreplies {
-			n.Listen.DelListener(replies[rep], t)
-		}
-		n.Listen.DelListener("PONG", t)
-		return
-	}(myreplies, t, n)
-	for _, rep := range myreplies {
-		n.Listen.RegListener(replies[rep], t, repch)
+	myreplies := []string{"ERR_NOORIGIN", "ERR_NOSUCHSERVER", "PONG"}
+	token := strconv.Itoa64(time.Nanoseconds())
+	q := n.newQuery(myreplies, nil, nil, false)
+	q.match = func(msg *IrcMessage) bool { //only our own PONG, pings may overlap
+		return msg.Cmd != "PONG" || (len(msg.Params) > 0 && msg.Params[len(msg.Params)-1] == token)
+	}
+	if err := n.send(&IrcMessage{"", "PING", []string{token}, nil}, q); err != nil {
+		return 0, err
 	}
-	n.Listen.RegListener("PONG", t, repch)
+	defer n.finish(q)
+	ticker := time.NewTicker(n.timeout())
+	defer ticker.Stop()
 	var rep *IrcMessage
-	n.queueOut <- &IrcMessage{"", "PING", []string{strconv.Itoa64(time.Nanoseconds())}}
 	select {
 	case <-ticker.C:
 		return 0, os.NewError("Timeout in receiving reply")
-	case rep = <-repch:
+	case rep = <-q.out:
 	}
 	if rep.Cmd == "PONG" {
 		origtime, err := strconv.Atoi64(rep.Params[len(rep.Params)-1])
 		if err == nil {
-			n.lag = time.Nanoseconds() - origtime
-			return n.lag, err
+			lag := time.Nanoseconds() - origtime
+			n.lags.add(lag)
+			return lag, err
 		} else {
 			return 0, err
 		}
@@ -725,58 +713,84 @@ func (n *Network) Ping() (int64, os.Error) {
 	return 0, os.NewError("Unknown error")
 }
 
-func (n *Network) Pong(msg string) {
-	n.queueOut <- &IrcMessage{"", "PONG", []string{msg}}
+func (n *Network) Pong(msg string) os.Error {
+	if msg == "" {
+		return n.Send(&IrcMessage{"", "PONG", []string{}, nil})
+	}
+	if err := n.Send(&IrcMessage{"", "PONG", []string{msg}, nil}); err != nil {
+		return err
+	}
 	//TODO: numeric replies? PingNick?
-	return
+	return nil
 }
 
-func (n *Network) Away(reason string) {
-	msg := &IrcMessage{"", "AWAY", []string{}}
+func (n *Network) Away(reason string) os.Error {
+	msg := &IrcMessage{"", "AWAY", []string{}, nil}
 	if reason != "" {
 		msg.Params = append(msg.Params, reason)
 	}
-	n.queueOut <- msg
+	if err := n.Send(msg); err != nil {
+		return err
+	}
 	//TODO: replies:
 	//RPL_UNAWAY                      RPL_NOWAWAY
-	return
+	return nil
 }
 
-func (n *Network) Users(server string) {
-	msg := &IrcMessage{"", "USERS", []string{}}
+func (n *Network) Users(server string) os.Error {
+	msg := &IrcMessage{"", "USERS", []string{}, nil}
 	if server != "" {
 		msg.Params = append(msg.Params, server)
 	}
-	n.queueOut <- msg
-	return
+	if err := n.Send(msg); err != nil {
+		return err
+	}
+	return nil
 }
 
-func (n *Network) Userhost(users []string) {
+func (n *Network) Userhost(users []string) os.Error {
 	if len(users) > 5 {
 		//todo cycle them 5-by-5?
-		return
+		return os.NewError("USERHOST takes at most 5 nicks")
+	}
+	if err := n.Send(&IrcMessage{"", "USERHOST", []string{strings.Join(users, " ")}, nil}); err != nil {
+		return err
 	}
-	n.queueOut <- &IrcMessage{"", "USERHOST", []string{strings.Join(users, " ")}}
 	//TODO: replies
 	//RPL_USERHOST                    ERR_NEEDMOREPARAMS
-	return
+	return nil
 }
 
-func (n *Network) Ison(users []string) {
-	if len(users) > 53 { //maximum number of nicks: 512/9 9 is max length of a nick
-		return
+func (n *Network) Ison(users []string) os.Error {
+	//as many nicks per line as fit in 510 bytes
+	nicklen := n.isupport.get().NickLen
+	if nicklen < 1 { //unknown or bogus, use the rfc one
+		nicklen = 9
+	}
+	max := (510 - len("ISON :")) / (nicklen + 1)
+	if max < 1 {
+		max = 1
+	}
+	for len(users) > max {
+		if err := n.Send(&IrcMessage{"", "ISON", []string{strings.Join(users[:max], " ")}, nil}); err != nil {
+			return err
+		}
+		users = users[max:]
+	}
+	if err := n.Send(&IrcMessage{"", "ISON", []string{strings.Join(users, " ")}, nil}); err != nil {
+		return err
 	}
-	n.queueOut <- &IrcMessage{"", "ISON", []string{strings.Join(users, " ")}}
 	//TODO: replies
 	//RPL_ISON                ERR_NEEDMOREPARAMS
-	return
+	return nil
 }
 
-func (n *Network) SendRaw(raw string) {
+func (n *Network) SendRaw(raw string) os.Error {
 	msg, err := PackMsg(raw)
-	if err == nil {
-		n.queueOut <- &msg
+	if err != nil {
+		return err
 	}
+	return n.Send(&msg)
 }
 
 func (n *Network) SetPort(port string) {
@@ -789,6 +803,12 @@ func (n *Network) SetNetwork(net string) {
 	n.Reconnect("Changing server.")
 }
 
+//SetShutdownTimeout sets how long Disconnect waits for the goroutines serving
+//the connection to exit.
+func (n *Network) SetShutdownTimeout(t int64) {
+	n.shutdownTimeout = t
+}
+
 func (n *Network) SetVersion(newversion string) {
 	IRCVERSION = newversion
 }
@@ -0,0 +1,261 @@
+package ircchans
+
+import (
+	"os"
+	"strings"
+	"strconv"
+	"sync"
+)
+
+//ISupport holds the server features advertised in RPL_ISUPPORT (005). Fields
+//the server didn't advertise keep their rfc 2812 defaults.
+type ISupport struct {
+	NickLen       int //0 until the server advertises it
+	UserLen       int //0 until the server advertises it
+	ChannelLen    int //0 if unlimited
+	TopicLen      int //0 if unlimited
+	ChanTypes     string
+	PrefixModes   string //channel membership modes, e.g. "ov"
+	PrefixSymbols string //their symbols in the same order, e.g. "@+"
+	ChanModes     [4]string //list modes, modes with a parameter, with a parameter when set, without a parameter
+	Modes         int //parameter modes per MODE command
+	TargMax       map[string]int //maximum targets per command, 0 if unlimited
+	CaseMapping   string
+	Network       string
+	Monitor       int //0 if MONITOR isn't supported, -1 if unlimited
+	Tokens        map[string]string //every token advertised, with its value
+}
+
+func defaultISupport() *ISupport {
+	return &ISupport{
+		ChannelLen:    50,
+		ChanTypes:     "#&+!",
+		PrefixModes:   "ov",
+		PrefixSymbols: "@+",
+		ChanModes:     [4]string{"b", "k", "l", "psitnm"},
+		Modes:         3,
+		TargMax:       make(map[string]int),
+		CaseMapping:   "rfc1459",
+		Tokens:        make(map[string]string),
+	}
+}
+
+func (s *ISupport) copy() *ISupport {
+	ret := new(ISupport)
+	*ret = *s
+	ret.TargMax = make(map[string]int)
+	for k, v := range s.TargMax {
+		ret.TargMax[k] = v
+	}
+	ret.Tokens = make(map[string]string)
+	for k, v := range s.Tokens {
+		ret.Tokens[k] = v
+	}
+	return ret
+}
+
+//unescapeISupport decodes the \xHH escapes allowed in token values
+func unescapeISupport(value string) string {
+	for i := strings.Index(value, "\\x"); i > -1 && i+4 <= len(value); i = strings.Index(value, "\\x") {
+		c, err := strconv.Btoui64(value[i+2:i+4], 16)
+		if err != nil {
+			break
+		}
+		value = value[:i] + string(byte(c)) + value[i+4:]
+	}
+	return value
+}
+
+//parse applies the tokens of a 005 line, "-TOKEN" restores the default
+func (s *ISupport) parse(tokens []string) {
+	for _, tok := range tokens {
+		if strings.HasPrefix(tok, "-") {
+			s.Tokens[tok[1:]] = "", false
+			s.unset(tok[1:])
+			continue
+		}
+		name, value := tok, ""
+		if i := strings.Index(tok, "="); i > -1 {
+			name, value = tok[:i], unescapeISupport(tok[i+1:])
+		}
+		s.Tokens[name] = value
+		s.set(name, value)
+	}
+}
+
+func (s *ISupport) set(name, value string) {
+	atoi := func(dflt int) int {
+		if v, err := strconv.Atoi(value); err == nil {
+			return v
+		}
+		return dflt
+	}
+	switch name {
+	case "NICKLEN", "MAXNICKLEN":
+		s.NickLen = atoi(s.NickLen)
+	case "USERLEN":
+		s.UserLen = atoi(s.UserLen)
+	case "CHANNELLEN":
+		s.ChannelLen = atoi(0)
+	case "TOPICLEN":
+		s.TopicLen = atoi(0)
+	case "CHANTYPES":
+		s.ChanTypes = value
+	case "PREFIX":
+		s.PrefixModes, s.PrefixSymbols = "", ""
+		if i := strings.Index(value, ")"); strings.HasPrefix(value, "(") && i > -1 {
+			s.PrefixModes, s.PrefixSymbols = value[1:i], value[i+1:]
+		}
+	case "CHANMODES":
+		s.ChanModes = [4]string{}
+		for i, m := range strings.Split(value, ",", 4) {
+			s.ChanModes[i] = m
+		}
+	case "MODES":
+		s.Modes = atoi(0)
+	case "TARGMAX":
+		s.TargMax = make(map[string]int)
+		for _, t := range strings.Split(value, ",", -1) {
+			if i := strings.Index(t, ":"); i > -1 {
+				max, _ := strconv.Atoi(t[i+1:])
+				s.TargMax[strings.ToUpper(t[:i])] = max
+			}
+		}
+	case "MAXTARGETS": //obsolete, TARGMAX wins
+		if _, ok := s.Tokens["TARGMAX"]; !ok {
+			s.TargMax["PRIVMSG"] = atoi(0)
+			s.TargMax["NOTICE"] = atoi(0)
+		}
+	case "CASEMAPPING":
+		s.CaseMapping = value
+	case "NETWORK":
+		s.Network = value
+	case "MONITOR":
+		s.Monitor = atoi(-1)
+	}
+}
+
+func (s *ISupport) unset(name string) {
+	def := defaultISupport()
+	switch name {
+	case "NICKLEN", "MAXNICKLEN":
+		s.NickLen = def.NickLen
+	case "USERLEN":
+		s.UserLen = def.UserLen
+	case "CHANNELLEN":
+		s.ChannelLen = def.ChannelLen
+	case "TOPICLEN":
+		s.TopicLen = def.TopicLen
+	case "CHANTYPES":
+		s.ChanTypes = def.ChanTypes
+	case "PREFIX":
+		s.PrefixModes, s.PrefixSymbols = def.PrefixModes, def.PrefixSymbols
+	case "CHANMODES":
+		s.ChanModes = def.ChanModes
+	case "MODES":
+		s.Modes = def.Modes
+	case "TARGMAX", "MAXTARGETS":
+		s.TargMax = make(map[string]int)
+	case "CASEMAPPING":
+		s.CaseMapping = def.CaseMapping
+	case "NETWORK":
+		s.Network = def.Network
+	case "MONITOR":
+		s.Monitor = def.Monitor
+	}
+}
+
+//IsChannel tells whether name is a channel according to CHANTYPES
+func (s *ISupport) IsChannel(name string) bool {
+	return name != "" && strings.IndexRune(s.ChanTypes, int(name[0])) > -1
+}
+
+//Fold returns the lower case form of a nick or channel name according to
+//CASEMAPPING, for comparisons
+func (s *ISupport) Fold(name string) string {
+	upper := "[]\\~"
+	lower := "{}|^"
+	switch s.CaseMapping {
+	case "ascii":
+		upper, lower = "", ""
+	case "strict-rfc1459":
+		upper, lower = "[]\\", "{}|"
+	}
+	return strings.Map(func(c int) int {
+		if c >= 'A' && c <= 'Z' {
+			return c + 'a' - 'A'
+		}
+		if i := strings.IndexRune(upper, c); i > -1 {
+			return int(lower[i])
+		}
+		return c
+	}, name)
+}
+
+type isupportTracker struct {
+	lock      *sync.Mutex
+	cur       *ISupport
+	listeners *notifier
+}
+
+func newISupportTracker() *isupportTracker {
+	return &isupportTracker{new(sync.Mutex), defaultISupport(), newNotifier()}
+}
+
+func (t *isupportTracker) get() *ISupport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.cur
+}
+
+//update applies the tokens and notifies the listeners without blocking
+func (t *isupportTracker) update(tokens []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s := t.cur.copy()
+	s.parse(tokens)
+	t.cur = s
+	t.listeners.notify(s)
+}
+
+func (t *isupportTracker) reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.cur = defaultISupport()
+}
+
+//ISupport returns the features advertised by the server
+func (n *Network) ISupport() *ISupport {
+	return n.isupport.get().copy()
+}
+
+//RegISupportListener registers ch to receive the server features after every
+//RPL_ISUPPORT line. Updates are dropped when ch isn't ready.
+func (n *Network) RegISupportListener(ch chan *ISupport) (*Subscription, os.Error) {
+	if ch == nil {
+		return nil, os.NewError("Can't register isupport listener: nil channel")
+	}
+	return n.isupport.listeners.add(ch, func(v interface{}) bool {
+		ok := ch <- v.(*ISupport).copy() //each listener gets its own
+		return ok
+	}, func() { close(ch) }), nil
+}
+
+//isupporter keeps the server features up to date
+func (n *Network) isupporter(quit chan bool) {
+	ch := make(chan *IrcMessage, internalBuffer)
+	sub, _ := n.Listen.RegListener([]string{replies["RPL_ISUPPORT"]}, ch)
+	defer sub.Close()
+	for {
+		select {
+		case msg := <-ch:
+			if msg == nil || len(msg.Params) < 3 {
+				continue
+			}
+			n.isupport.update(msg.Params[1 : len(msg.Params)-1])
+		case <-quit:
+			return
+		}
+	}
+	return
+}
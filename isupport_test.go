@@ -0,0 +1,43 @@
+package ircchans
+
+import (
+	"testing"
+	"strings"
+)
+
+func TestISupportParse(t *testing.T) {
+	s := defaultISupport()
+	s.parse([]string{"NICKLEN=30", "CHANTYPES=#", "PREFIX=(qaohv)~&@%+", "CHANMODES=beI,k,l,imnpst",
+		"MODES=4", "TARGMAX=PRIVMSG:4,NOTICE:4,JOIN:", "CASEMAPPING=ascii", "NETWORK=Test\\x20Net", "MONITOR"})
+	if s.NickLen != 30 {
+		t.Errorf("NICKLEN: got %d, expected 30", s.NickLen)
+	}
+	if s.IsChannel("&local") || !s.IsChannel("#chan") {
+		t.Errorf("CHANTYPES: got %s, expected #", s.ChanTypes)
+	}
+	if s.PrefixModes != "qaohv" || s.PrefixSymbols != "~&@%+" {
+		t.Errorf("PREFIX: got %s %s", s.PrefixModes, s.PrefixSymbols)
+	}
+	if strings.Join(s.ChanModes[:], ",") != "beI,k,l,imnpst" {
+		t.Errorf("CHANMODES: got %#v", s.ChanModes)
+	}
+	if s.Modes != 4 || s.TargMax["PRIVMSG"] != 4 || s.TargMax["JOIN"] != 0 {
+		t.Errorf("MODES/TARGMAX: got %d %#v", s.Modes, s.TargMax)
+	}
+	if s.Network != "Test Net" {
+		t.Errorf("NETWORK: got %#v, expected \"Test Net\"", s.Network)
+	}
+	if s.Monitor != -1 {
+		t.Errorf("MONITOR: got %d, expected -1 (unlimited)", s.Monitor)
+	}
+	if s.Fold("Nick[]") != "nick[]" {
+		t.Errorf("CASEMAPPING=ascii: got %s", s.Fold("Nick[]"))
+	}
+	s.parse([]string{"-NICKLEN", "-CASEMAPPING"})
+	if s.NickLen != 0 || s.Fold("Nick[]") != "nick{}" {
+		t.Errorf("Negated tokens: got NICKLEN %d, %s", s.NickLen, s.Fold("Nick[]"))
+	}
+	if _, ok := s.Tokens["NICKLEN"]; ok {
+		t.Error("Negated token still listed")
+	}
+}
@@ -0,0 +1,139 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	lagWindow      = 20 //number of samples kept for the statistics
+	defaultTimeout = second * 3
+	minTimeout     = second
+	maxTimeout     = second * 30
+)
+
+//LagStats summarises the round-trip times of the last pings, in nanoseconds
+type LagStats struct {
+	Last, Min, Avg, Max, P95 int64
+	Samples                  int
+	LastSample               int64 //time.Nanoseconds() when Last was measured
+}
+
+func (s LagStats) String() string {
+	return fmt.Sprintf("last %d, min %d, avg %d, max %d, p95 %d nanoseconds over %d samples", s.Last, s.Min, s.Avg, s.Max, s.P95, s.Samples)
+}
+
+type int64Array []int64
+
+func (a int64Array) Len() int           { return len(a) }
+func (a int64Array) Less(i, j int) bool { return a[i] < a[j] }
+func (a int64Array) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+type lagTracker struct {
+	lock      *sync.Mutex
+	samples   []int64 //ring buffer of the last lagWindow samples
+	next      int
+	last      int64
+	lastAt    int64
+	listeners *notifier
+}
+
+func newLagTracker() *lagTracker {
+	return &lagTracker{new(sync.Mutex), make([]int64, 0, lagWindow), 0, 0, 0, newNotifier()}
+}
+
+//stats computes the statistics, the caller must hold the lock
+func (l *lagTracker) stats() LagStats {
+	s := LagStats{Last: l.last, Samples: len(l.samples), LastSample: l.lastAt}
+	if len(l.samples) == 0 {
+		return s
+	}
+	sorted := make(int64Array, len(l.samples))
+	copy(sorted, l.samples)
+	sort.Sort(sorted)
+	var sum int64
+	for _, v := range sorted {
+		sum += v
+	}
+	s.Min = sorted[0]
+	s.Max = sorted[len(sorted)-1]
+	s.Avg = sum / int64(len(sorted))
+	s.P95 = sorted[(len(sorted)*95+99)/100-1]
+	return s
+}
+
+//add records a sample and notifies the lag listeners without blocking
+func (l *lagTracker) add(lag int64) LagStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.samples) < lagWindow {
+		l.samples = append(l.samples, lag)
+	} else {
+		l.samples[l.next] = lag
+	}
+	l.next = (l.next + 1) % lagWindow
+	l.last = lag
+	l.lastAt = time.Nanoseconds()
+	s := l.stats()
+	l.listeners.notify(s)
+	return s
+}
+
+//reset forgets the samples, the next connection may go somewhere else
+func (l *lagTracker) reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.samples = l.samples[:0]
+	l.next = 0
+	l.last = 0
+	l.lastAt = 0
+}
+
+//timeout is how long to wait for the reply to a command: three times the
+//worst recent lag plus some slack for the server, within sane bounds
+func (l *lagTracker) timeout() int64 {
+	l.lock.Lock()
+	s := l.stats()
+	l.lock.Unlock()
+	if s.Samples == 0 {
+		return defaultTimeout
+	}
+	base := s.P95
+	if s.Last > base {
+		base = s.Last
+	}
+	t := base*3 + second/2
+	if t < minTimeout {
+		return minTimeout
+	}
+	if t > maxTimeout {
+		return maxTimeout
+	}
+	return t
+}
+
+//Lag returns the statistics of the recent round-trip times to the server
+func (n *Network) Lag() LagStats {
+	n.lags.lock.Lock()
+	defer n.lags.lock.Unlock()
+	return n.lags.stats()
+}
+
+//RegLagListener registers ch to receive the statistics after every ping.
+//Updates are dropped when ch isn't ready.
+func (n *Network) RegLagListener(ch chan LagStats) (*Subscription, os.Error) {
+	if ch == nil {
+		return nil, os.NewError("Can't register lag listener: nil channel")
+	}
+	return n.lags.listeners.add(ch, func(v interface{}) bool {
+		ok := ch <- v.(LagStats)
+		return ok
+	}, func() { close(ch) }), nil
+}
+
+func (n *Network) timeout() int64 {
+	return n.lags.timeout()
+}
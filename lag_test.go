@@ -0,0 +1,72 @@
+package ircchans
+
+import (
+	"testing"
+)
+
+const millisecond = second / 1000
+
+func TestLagStats(t *testing.T) {
+	l := newLagTracker()
+	for i := int64(1); i <= lagWindow; i++ {
+		l.add(i * millisecond)
+	}
+	s := l.add(21 * millisecond) //pushes the first sample out of the window
+	if s.Samples != lagWindow || s.Last != 21*millisecond {
+		t.Errorf("Bad window: %s", s.String())
+	}
+	if s.Min != 2*millisecond || s.Max != 21*millisecond || s.P95 != 20*millisecond {
+		t.Errorf("Bad statistics: %s", s.String())
+	}
+	if s.Avg != (230*millisecond)/lagWindow {
+		t.Errorf("Bad average: %s", s.String())
+	}
+}
+
+func TestLagTimeout(t *testing.T) {
+	l := newLagTracker()
+	if to := l.timeout(); to != defaultTimeout {
+		t.Errorf("Timeout without samples: %d", to)
+	}
+	l.add(1)
+	if to := l.timeout(); to != minTimeout {
+		t.Errorf("Timeout not clamped to the minimum: %d", to)
+	}
+	l.add(minute)
+	if to := l.timeout(); to != maxTimeout {
+		t.Errorf("Timeout not clamped to the maximum: %d", to)
+	}
+	l.reset()
+	l.add(second * 2)
+	l.add(1)
+	if to := l.timeout(); to != second*6+second/2 {
+		t.Errorf("Timeout not from the p95: %d", to)
+	}
+}
+
+func TestLagListener(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	ch := make(chan LagStats, 1)
+	sub, err := n.RegLagListener(ch)
+	if err != nil {
+		t.Fatalf("Register error: %s", err.String())
+	}
+	n.lags.add(second)
+	n.lags.add(second * 2) //ch is full
+	if s, _ := sub.Stats(); s.Delivered != 1 || s.Dropped != 1 {
+		t.Errorf("Bad counters: %+v", s)
+	}
+	if s := <-ch; s.Last != second {
+		t.Errorf("Got %s, expected the first sample", s)
+	}
+	sub.Close()
+	if _, ok := <-ch; !closed(ch) {
+		t.Errorf("Channel not closed with its subscription")
+	}
+	if err := sub.Close(); err == nil {
+		t.Errorf("Closed twice")
+	}
+	if _, err := n.RegLagListener(nil); err == nil {
+		t.Errorf("Registered a nil channel")
+	}
+}
@@ -5,18 +5,74 @@ import (
 	"strings"
 	"bytes"
 	"fmt"
+	"sort"
 )
 
 type IrcMessage struct {
 	Prefix string
 	Cmd    string
 	Params []string
+	Tags   map[string]string //ircv3 message tags, nil if there are none
+}
+
+//escaping of message tag values
+var (
+	tagEscapes   = []string{"\\\\", "\\", "\\:", ";", "\\s", " ", "\\r", "\r", "\\n", "\n"}
+	tagUnescaped = map[byte]string{'\\': "\\", ':': ";", 's': " ", 'r': "\r", 'n': "\n"}
+)
+
+func escapeTag(value string) string {
+	for i := 0; i < len(tagEscapes); i += 2 {
+		value = strings.Replace(value, tagEscapes[i+1], tagEscapes[i], -1)
+	}
+	return value
+}
+
+func unescapeTag(value string) string {
+	ret := bytes.NewBufferString("")
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			ret.WriteByte(value[i])
+		} else if i+1 < len(value) {
+			i++
+			if s, ok := tagUnescaped[value[i]]; ok {
+				ret.WriteString(s)
+			} else {
+				ret.WriteByte(value[i])
+			}
+		}
+	}
+	return ret.String()
+}
+
+//parseTags decodes the tags of a message, without the leading @
+func parseTags(tags string) map[string]string {
+	ret := make(map[string]string)
+	for _, tag := range strings.Split(tags, ";", -1) {
+		if tag == "" {
+			continue
+		}
+		if i := strings.Index(tag, "="); i > -1 {
+			ret[tag[:i]] = unescapeTag(tag[i+1:])
+		} else {
+			ret[tag] = ""
+		}
+	}
+	return ret
 }
 
 
 func PackMsg(msg string) (IrcMessage, os.Error) { //TODO: this needs work?
 	var ret IrcMessage
 	err := "Errors encountered during message packing: "
+	if strings.HasPrefix(msg, "@") {
+		if i := strings.Index(msg, " "); i > -1 {
+			ret.Tags = parseTags(msg[1:i])
+			msg = strings.TrimLeft(msg[i+1:], " ")
+		} else {
+			err += "Malformed tags, "
+		}
+	}
 	if strings.HasPrefix(msg, ":") {
 		if i := strings.Index(msg, " "); i > -1 {
 			ret.Prefix = msg[1:i]
@@ -28,10 +84,16 @@ func PackMsg(msg string) (IrcMessage, os.Error) { //TODO: this needs work?
 	if i := strings.Index(msg, " "); i > -1 {
 		ret.Cmd = msg[0:i]
 		msg = msg[i+1:]
+	} else if msg != "" { //no parameters, like ACK
+		ret.Cmd = msg
+		msg = ""
 	} else {
 		err += "No command found, "
 	}
-	ret.Params = strings.Split(msg, " ", -1)
+	ret.Params = make([]string, 0)
+	if msg != "" {
+		ret.Params = strings.Split(msg, " ", -1)
+	}
 	for i, m := range ret.Params {
 		if strings.HasPrefix(m, ":") {
 			ret.Params[i] = ret.Params[i][1:]
@@ -66,17 +128,40 @@ func (m *IrcMessage) String() string {
 			break
 		}
 	}
-	if msg.Len() > 510 {
+	if msg.Len() > 510 { //tags don't count
 		return ""
 	}
-	return msg.String()
+	if len(m.Tags) == 0 {
+		return msg.String()
+	}
+	keys := make([]string, 0, len(m.Tags))
+	for k, _ := range m.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) //always the same line for the same message
+	for i, k := range keys {
+		if v := m.Tags[k]; v != "" {
+			keys[i] = k + "=" + escapeTag(v)
+		}
+	}
+	return "@" + strings.Join(keys, ";") + " " + msg.String()
+}
+
+//withTag returns a copy of m with the tag set, m itself is left alone
+func (m *IrcMessage) withTag(key, value string) *IrcMessage {
+	tags := make(map[string]string)
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+	tags[key] = value
+	return &IrcMessage{m.Prefix, m.Cmd, m.Params, tags}
 }
 
 func (m *IrcMessage) Origin() string {
 	if m.Prefix != "" {
 		return m.Prefix
 	} else {
-		if m.Cmd == "PRIVMSG" {
+		if m.Cmd == "PRIVMSG" && len(m.Params) > 0 {
 			return m.Params[0]
 		}
 	}
@@ -84,14 +169,14 @@ func (m *IrcMessage) Origin() string {
 }
 
 func (m *IrcMessage) Destination() string {
-	if m.Cmd == "PRIVMSG" {
+	if m.Cmd == "PRIVMSG" && len(m.Params) > 0 {
 		return m.Params[0]
 	}
 	return ""
 }
 
 func (m *IrcMessage) Payload() string {
-	if m.Cmd == "PRIVMSG" {
+	if m.Cmd == "PRIVMSG" && len(m.Params) > 0 {
 		return strings.Join(m.Params[1:], " ")
 	}
 	return ""
@@ -0,0 +1,31 @@
+package ircchans
+
+import (
+	"testing"
+)
+
+func TestPackMsgNoParams(t *testing.T) {
+	for _, l := range []string{"PING", ":server PONG", "@label=ic1 :server ACK"} {
+		msg, err := PackMsg(l)
+		if err != nil {
+			t.Errorf("Couldn't pack %s: %s", l, err.String())
+			continue
+		}
+		if msg.Cmd == "" || len(msg.Params) != 0 {
+			t.Errorf("Bad message from %s: %#v", l, msg)
+		}
+		if msg.Origin() != msg.Prefix || msg.Destination() != "" || msg.Payload() != "" {
+			t.Errorf("Accessors broken without parameters: %#v", msg)
+		}
+	}
+	msg, _ := PackMsg(":nick!u@h PRIVMSG")
+	if msg.Destination() != "" || msg.Payload() != "" {
+		t.Errorf("PRIVMSG without parameters: %#v", msg)
+	}
+	if _, err := PackMsg(""); err == nil {
+		t.Errorf("Empty line packed")
+	}
+	if s := (&IrcMessage{"", "PONG", []string{}, nil}).String(); s != "PONG" {
+		t.Errorf("Bad PONG without token: %#v", s)
+	}
+}
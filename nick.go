@@ -0,0 +1,237 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"strconv"
+	"time"
+)
+
+//NickChange is sent to the nick listeners when our own nick changes
+type NickChange struct {
+	Old, New string
+}
+
+//AltNickFunc returns the nick to try when registering after attempt nicks
+//(the preferred one included) were refused, or "" to give up
+type AltNickFunc func(preferred string, attempt int, isupport *ISupport) string
+
+//AltNickList tries the given nicks in order
+func AltNickList(nicks ...string) AltNickFunc {
+	return func(preferred string, attempt int, isupport *ISupport) string {
+		if attempt > len(nicks) {
+			return ""
+		}
+		return nicks[attempt-1]
+	}
+}
+
+//AltNickSuffix appends 1, 2, ... up to max to the preferred nick, shortening it
+//to fit NICKLEN. This is the default.
+func AltNickSuffix(max int) AltNickFunc {
+	return func(preferred string, attempt int, isupport *ISupport) string {
+		if attempt > max {
+			return ""
+		}
+		suffix := strconv.Itoa(attempt)
+		if l := isupport.NickLen - len(suffix); l > 0 && len(preferred) > l {
+			preferred = preferred[:l]
+		}
+		return preferred + suffix
+	}
+}
+
+//ways to get the preferred nick back when we had to register with another one
+const (
+	REGAINOFF      = iota
+	REGAINWATCH    //take the nick as soon as its holder quits or changes nick
+	REGAINSERVICES //also ask NickServ to free the nick right away
+)
+
+//SetAltNick chooses how alternate nicks are picked when registering
+func (n *Network) SetAltNick(f AltNickFunc) {
+	n.altnick = f
+}
+
+//SetRegain enables getting the preferred nick back. With REGAINSERVICES,
+//command is the NickServ command to use (GHOST, RECOVER or REGAIN) and
+//password the one of the nick's account.
+func (n *Network) SetRegain(mode int, command, password string) {
+	n.regainmode = mode
+	n.regaincmd = command
+	n.regainpass = password
+}
+
+//GetNick returns our current nick, as the server knows it
+func (n *Network) GetNick() string {
+	n.nickLock.Lock()
+	defer n.nickLock.Unlock()
+	return n.nick
+}
+
+//GetPreferredNick returns the nick we ask for when registering
+func (n *Network) GetPreferredNick() string {
+	n.nickLock.Lock()
+	defer n.nickLock.Unlock()
+	return n.prefnick
+}
+
+//RegNickListener registers ch to receive our own nick changes, whether we
+//asked for them or the server forced them. Changes are dropped when ch isn't
+//ready.
+func (n *Network) RegNickListener(ch chan NickChange) (*Subscription, os.Error) {
+	if ch == nil {
+		return nil, os.NewError("Can't register nick listener: nil channel")
+	}
+	return n.nicklisteners.add(ch, func(v interface{}) bool {
+		ok := ch <- v.(NickChange)
+		return ok
+	}, func() { close(ch) }), nil
+}
+
+func (n *Network) setNick(nick string) {
+	n.nickLock.Lock()
+	defer n.nickLock.Unlock()
+	n.changeNick(nick)
+}
+
+//guessNick sets the nick we registered with, unless the welcome message
+//already told us the one we got
+func (n *Network) guessNick(nick string) {
+	n.nickLock.Lock()
+	defer n.nickLock.Unlock()
+	if !n.welcomed {
+		n.changeNick(nick)
+	}
+}
+
+//welcome sets the nick the server registered us with
+func (n *Network) welcome(nick string) {
+	n.nickLock.Lock()
+	defer n.nickLock.Unlock()
+	n.welcomed = true
+	n.changeNick(nick)
+}
+
+//changeNick notifies the nick listeners, the caller must hold the lock
+func (n *Network) changeNick(nick string) {
+	if nick == n.nick {
+		return
+	}
+	change := NickChange{n.nick, nick}
+	n.nick = nick
+	n.nicklisteners.notify(change)
+}
+
+//isMe tells whether a message prefix (nick!user@host) is us
+func (n *Network) isMe(prefix string) bool {
+	nick := strings.Split(prefix, "!", 2)[0]
+	isupport := n.isupport.get()
+	return isupport.Fold(nick) == isupport.Fold(n.GetNick())
+}
+
+//nicker follows our nick: the welcome message names us, and the server tells
+//us about every change, including the ones forced by services
+func (n *Network) nicker(quit chan bool) {
+	ch := make(chan *IrcMessage, internalBuffer)
+	sub, _ := n.Listen.RegListener([]string{replies["RPL_WELCOME"], "NICK"}, ch)
+	defer sub.Close()
+	for {
+		select {
+		case msg := <-ch:
+			if msg == nil || len(msg.Params) < 1 {
+				continue
+			}
+			if msg.Cmd == "NICK" && !n.isMe(msg.Prefix) {
+				continue
+			}
+			if msg.Cmd == replies["RPL_WELCOME"] {
+				n.welcome(msg.Params[0])
+			} else {
+				n.setNick(msg.Params[0])
+			}
+		case <-quit:
+			return
+		}
+	}
+	return
+}
+
+//regain tries to take the preferred nick if we don't have it
+func (n *Network) regain() {
+	pref := n.GetPreferredNick()
+	if n.isMe(pref) {
+		return
+	}
+	if _, err := n.nickCmd(pref); err != nil {
+		n.l.Printf("Couldn't regain nick %s: %s", pref, err.String())
+	}
+}
+
+//regainer watches for the preferred nick to become free when we don't have it:
+//its holder quits or changes nick, or MONITOR reports it offline
+func (n *Network) regainer(quit chan bool) {
+	ch := make(chan *IrcMessage, internalBuffer)
+	cmds := []string{replies["RPL_WELCOME"], "NICK", "QUIT", replies["RPL_MONOFFLINE"]}
+	sub, _ := n.Listen.RegListener(cmds, ch)
+	defer sub.Close()
+	nickch := make(chan NickChange, 10)
+	nicksub, _ := n.RegNickListener(nickch)
+	defer nicksub.Close()
+	monitoring := false
+	for {
+		select {
+		case msg := <-ch:
+			if msg == nil || n.regainmode == REGAINOFF {
+				continue
+			}
+			pref := n.GetPreferredNick()
+			isupport := n.isupport.get()
+			current := n.GetNick()
+			if msg.Cmd == replies["RPL_WELCOME"] && len(msg.Params) > 0 {
+				current = msg.Params[0] //the nicker may not have seen it yet
+			}
+			if isupport.Fold(pref) == isupport.Fold(current) {
+				continue
+			}
+			switch msg.Cmd {
+			case replies["RPL_WELCOME"]: //registered with an alternate nick
+				if isupport.Monitor != 0 {
+					n.queueOut <- &IrcMessage{"", "MONITOR", []string{"+", pref}, nil}
+					monitoring = true
+				}
+				if n.regainmode == REGAINSERVICES && n.regaincmd != "" {
+					n.queueOut <- &IrcMessage{"", "PRIVMSG", []string{"NickServ", fmt.Sprintf("%s %s %s", n.regaincmd, pref, n.regainpass)}, nil}
+					if strings.ToUpper(n.regaincmd) == "GHOST" { //the others give us the nick themselves
+						go func() {
+							time.Sleep(n.timeout())
+							n.regain()
+						}()
+					}
+				}
+			case "NICK", "QUIT":
+				if isupport.Fold(strings.Split(msg.Prefix, "!", 2)[0]) == isupport.Fold(pref) {
+					go n.regain()
+				}
+			case replies["RPL_MONOFFLINE"]:
+				if len(msg.Params) < 2 {
+					continue
+				}
+				for _, target := range strings.Split(msg.Params[1], ",", -1) {
+					if isupport.Fold(strings.Split(target, "!", 2)[0]) == isupport.Fold(pref) {
+						go n.regain()
+					}
+				}
+			}
+		case c := <-nickch:
+			if monitoring && n.isMe(n.GetPreferredNick()) {
+				n.queueOut <- &IrcMessage{"", "MONITOR", []string{"-", c.New}, nil}
+				monitoring = false
+			}
+		case <-quit:
+			return
+		}
+	}
+	return
+}
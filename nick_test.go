@@ -0,0 +1,58 @@
+package ircchans
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestWelcomeNick(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	n.welcome("me_") //the 001 came before NICK returned
+	n.guessNick("me")
+	if nick := n.GetNick(); nick != "me_" {
+		t.Errorf("Registration overwrote the nick from the welcome message: %s", nick)
+	}
+	n.setNick("other") //NICK changes always apply
+	if nick := n.GetNick(); nick != "other" {
+		t.Errorf("NICK didn't change the nick: %s", nick)
+	}
+}
+
+func TestRegainOnWelcome(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	n.isupport.update([]string{"MONITOR=100"})
+	n.SetRegain(REGAINWATCH, "", "")
+	quit := make(chan bool)
+	defer close(quit)
+	go n.regainer(quit)
+	for len(n.Listen.Subscriptions()) == 0 { //wait for the regainer to listen
+		runtime.Gosched()
+	}
+	//n.nick still is the preferred nick, only the welcome message tells otherwise
+	n.Listen.dispatch(IrcMessage{"server", replies["RPL_WELCOME"], []string{"me_", "Welcome"}, nil})
+	ticker := time.NewTicker(second)
+	defer ticker.Stop()
+	select {
+	case msg := <-n.queueOut:
+		if msg.Cmd != "MONITOR" || msg.Params[1] != "me" {
+			t.Errorf("Expected to monitor the preferred nick, got %s", msg)
+		}
+	case <-ticker.C:
+		t.Errorf("Registered with an alternate nick but not watching the preferred one")
+	}
+}
+
+func TestLongNickBeforeISupport(t *testing.T) {
+	n := NewNetwork("", "", "twelve_chars", "me", "me", "", logfile)
+	n.lags.add(1)
+	go n.nickCmd("twelve_chars")
+	if msg := <-n.queueOut; msg.Params[0] != "twelve_chars" {
+		t.Errorf("Nick cut before the server told its NICKLEN: %s", msg.Params[0])
+	}
+	n.isupport.update([]string{"NICKLEN=9"})
+	go n.nickCmd("twelve_chars")
+	if msg := <-n.queueOut; msg.Params[0] != "twelve_ch" {
+		t.Errorf("Nick not cut to NICKLEN: %s", msg.Params[0])
+	}
+}
@@ -0,0 +1,81 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//notifier feeds the listeners of one kind of update, like the lag statistics or
+//our nick changes. They get a Subscription like the message listeners: closing
+//the last subscription of a channel closes it, and updates are dropped, and
+//counted, when the channel isn't ready.
+type notifier struct {
+	lock *sync.Mutex
+	subs map[int64]*notified
+	refs map[interface{}]int //subscriptions by channel
+}
+
+type notified struct {
+	ch        interface{}
+	send      func(v interface{}) bool //writes to ch without blocking
+	close     func()
+	delivered int64
+	dropped   int64
+}
+
+func newNotifier() *notifier {
+	return &notifier{new(sync.Mutex), make(map[int64]*notified), make(map[interface{}]int)}
+}
+
+//add registers ch, send writes an update to it and close closes it
+func (n *notifier) add(ch interface{}, send func(v interface{}) bool, close func()) *Subscription {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	s := &Subscription{nextSubscriptionID(), nil, time.Nanoseconds(), nil, nil, n}
+	n.subs[s.ID] = &notified{ch, send, close, 0, 0}
+	n.refs[ch]++
+	return s
+}
+
+//notify gives v to every listener ready for it
+func (n *notifier) notify(v interface{}) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, l := range n.subs {
+		if l.send(v) {
+			l.delivered++
+		} else {
+			l.dropped++
+		}
+	}
+}
+
+func (n *notifier) remove(id int64) os.Error {
+	n.lock.Lock()
+	l, ok := n.subs[id]
+	if !ok {
+		n.lock.Unlock()
+		return os.NewError(fmt.Sprintf("Subscription %d is already closed", id))
+	}
+	n.subs[id] = nil, false
+	if n.refs[l.ch]--; n.refs[l.ch] > 0 {
+		n.lock.Unlock()
+		return nil
+	}
+	n.refs[l.ch] = 0, false
+	n.lock.Unlock()
+	l.close() //nothing is sent to it anymore
+	return nil
+}
+
+func (n *notifier) stats(id int64) (ListenerStats, os.Error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	l, ok := n.subs[id]
+	if !ok {
+		return ListenerStats{}, os.NewError(fmt.Sprintf("Subscription %d is closed", id))
+	}
+	return ListenerStats{l.delivered, l.dropped, 0}, nil
+}
@@ -0,0 +1,160 @@
+package ircchans
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+//RegistrationInfo is what the server told us while we registered: the welcome
+//burst (001-004), our initial user modes and the message of the day
+type RegistrationInfo struct {
+	Welcome      []string //text of RPL_WELCOME, RPL_YOURHOST and RPL_CREATED
+	Server       string   //server name from RPL_MYINFO
+	Version      string
+	UserModes    string //user modes the server supports
+	ChannelModes string //channel modes the server supports
+	InitialModes string //user modes set on us by the server during registration
+	Motd         []string
+	NoMotd       bool //the server answered ERR_NOMOTD
+}
+
+func (r *RegistrationInfo) copy() *RegistrationInfo {
+	ret := new(RegistrationInfo)
+	*ret = *r
+	ret.Welcome = make([]string, len(r.Welcome))
+	copy(ret.Welcome, r.Welcome)
+	ret.Motd = make([]string, len(r.Motd))
+	copy(ret.Motd, r.Motd)
+	return ret
+}
+
+//applyModes adds or removes the modes of a MODE change like "+iw-x" from modes
+func applyModes(modes, change string) string {
+	add := true
+	for _, c := range change {
+		switch c {
+		case '+':
+			add = true
+		case '-':
+			add = false
+		default:
+			i := strings.IndexRune(modes, c)
+			if add && i < 0 {
+				modes += string(c)
+			} else if !add && i > -1 {
+				modes = modes[:i] + modes[i+1:]
+			}
+		}
+	}
+	return modes
+}
+
+type regTracker struct {
+	lock     *sync.Mutex
+	info     *RegistrationInfo
+	finished bool
+	done     chan bool //closed once the motd, or its absence, was received
+}
+
+func newRegTracker() *regTracker {
+	return &regTracker{new(sync.Mutex), new(RegistrationInfo), false, make(chan bool)}
+}
+
+func (r *regTracker) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.info = new(RegistrationInfo)
+	r.finished = false
+	r.done = make(chan bool)
+}
+
+//Registration returns what the server sent while we registered. It is complete
+//once Connect returned, unless the server didn't finish its motd in time.
+func (n *Network) Registration() *RegistrationInfo {
+	n.reg.lock.Lock()
+	defer n.reg.lock.Unlock()
+	return n.reg.info.copy()
+}
+
+//waitMotd waits for the end of the motd, it returns false on timeout
+func (n *Network) waitMotd() bool {
+	n.reg.lock.Lock()
+	done := n.reg.done
+	n.reg.lock.Unlock()
+	ticker := time.NewTicker(n.timeout())
+	defer ticker.Stop()
+	select {
+	case <-done:
+	case <-ticker.C:
+		return false
+	}
+	return true
+}
+
+//registrar records the welcome burst, our user modes and the motd until the
+//motd ends
+func (n *Network) registrar(quit chan bool) {
+	ch := make(chan *IrcMessage, internalBuffer)
+	cmds := replyCodes("RPL_WELCOME", "RPL_YOURHOST", "RPL_CREATED", "RPL_MYINFO", "RPL_UMODEIS", "RPL_MOTDSTART", "RPL_MOTD", "RPL_ENDOFMOTD", "ERR_NOMOTD", "MODE")
+	sub, _ := n.Listen.RegListener(cmds, ch)
+	defer sub.Close()
+	for {
+		var msg *IrcMessage
+		select {
+		case msg = <-ch:
+		case <-quit:
+			return
+		}
+		if msg == nil || len(msg.Params) < 1 {
+			continue
+		}
+		text := msg.Params[len(msg.Params)-1]
+		n.reg.lock.Lock()
+		if n.reg.finished { //a later MOTD or MODE isn't part of the registration
+			n.reg.lock.Unlock()
+			continue
+		}
+		info := n.reg.info
+		switch msg.Cmd {
+		case replies["RPL_WELCOME"], replies["RPL_YOURHOST"], replies["RPL_CREATED"]:
+			info.Welcome = append(info.Welcome, text)
+		case replies["RPL_MYINFO"]:
+			//<nick> <server> <version> <user modes> <channel modes> [<modes with parameter>]
+			p := msg.Params
+			if len(p) > 1 {
+				info.Server = p[1]
+			}
+			if len(p) > 2 {
+				info.Version = p[2]
+			}
+			if len(p) > 3 {
+				info.UserModes = p[3]
+			}
+			if len(p) > 4 {
+				info.ChannelModes = p[4]
+			}
+		case replies["RPL_UMODEIS"]:
+			if len(msg.Params) > 1 {
+				info.InitialModes = applyModes("", msg.Params[1])
+			}
+		case "MODE":
+			if len(msg.Params) > 1 && n.isMe(msg.Params[0]) {
+				info.InitialModes = applyModes(info.InitialModes, strings.Join(msg.Params[1:], ""))
+			}
+		case replies["RPL_MOTDSTART"]:
+			info.Motd = make([]string, 0)
+		case replies["RPL_MOTD"]:
+			if strings.HasPrefix(text, "- ") {
+				text = text[2:]
+			}
+			info.Motd = append(info.Motd, text)
+		case replies["RPL_ENDOFMOTD"], replies["ERR_NOMOTD"]:
+			info.NoMotd = msg.Cmd == replies["ERR_NOMOTD"]
+			n.reg.finished = true
+			close(n.reg.done)
+		}
+		n.reg.lock.Unlock()
+	}
+	return
+}
@@ -0,0 +1,425 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"strconv"
+	"time"
+	"bytes"
+	"io"
+	"hash"
+	"encoding/base64"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+)
+
+//what to do when sasl authentication fails during registration
+const (
+	SASLCONTINUE = iota //register anyway, without being logged in
+	SASLABORT           //fail the registration
+)
+
+const saslChunk = 400 //AUTHENTICATE payloads are split in chunks of this size
+
+//SaslMechanism is the client side of a sasl mechanism
+type SaslMechanism interface {
+	Name() string
+	//Next answers a challenge from the server, the first call gets an empty
+	//challenge
+	Next(challenge []byte) ([]byte, os.Error)
+}
+
+type saslPlain struct {
+	authzid, user, pass string
+}
+
+//SaslPlain authenticates with an account name and a password
+func SaslPlain(user, pass string) SaslMechanism {
+	return &saslPlain{"", user, pass}
+}
+
+func (m *saslPlain) Name() string {
+	return "PLAIN"
+}
+
+func (m *saslPlain) Next(challenge []byte) ([]byte, os.Error) {
+	return []byte(strings.Join([]string{m.authzid, m.user, m.pass}, "\x00")), nil
+}
+
+type saslExternal struct {
+	authzid string
+}
+
+//SaslExternal authenticates with the client certificate presented on tls
+//connections (see CustomTlsConf). The account is the one the certificate's
+//fingerprint was added to, CertFingerprint gives that fingerprint.
+func SaslExternal() SaslMechanism {
+	return &saslExternal{""}
+}
+
+func (m *saslExternal) Name() string {
+	return "EXTERNAL"
+}
+
+func (m *saslExternal) Next(challenge []byte) ([]byte, os.Error) {
+	return []byte(m.authzid), nil
+}
+
+//CertFingerprint returns the sha-256 fingerprint of our client certificate in
+//hex, as services use it for CertFP
+func CertFingerprint() (string, os.Error) {
+	conf, err := CustomTlsConf()
+	if err != nil {
+		return "", err
+	}
+	if len(conf.Certificates) == 0 || len(conf.Certificates[0].Certificate) == 0 {
+		return "", os.NewError("No client certificate configured")
+	}
+	h := sha256.New()
+	h.Write(conf.Certificates[0].Certificate[0])
+	return fmt.Sprintf("%x", h.Sum()), nil
+}
+
+//saslScram implements the SCRAM-SHA-* mechanisms (rfc 5802, rfc 7677)
+type saslScram struct {
+	name            string
+	hash            func() hash.Hash
+	user, pass      string
+	step            int
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+	verified        bool
+}
+
+//SaslScramSha1 authenticates with SCRAM-SHA-1, the server proves it knows our
+//password too
+func SaslScramSha1(user, pass string) SaslMechanism {
+	return &saslScram{name: "SCRAM-SHA-1", hash: sha1.New, user: user, pass: pass}
+}
+
+//SaslScramSha256 authenticates with SCRAM-SHA-256, the server proves it knows
+//our password too
+func SaslScramSha256(user, pass string) SaslMechanism {
+	return &saslScram{name: "SCRAM-SHA-256", hash: sha256.New, user: user, pass: pass}
+}
+
+func (m *saslScram) Name() string {
+	return m.name
+}
+
+func (m *saslScram) Verified() bool {
+	return m.verified
+}
+
+func (m *saslScram) hmac(key []byte, data string) []byte {
+	h := hmac.New(m.hash, key)
+	h.Write([]byte(data))
+	return h.Sum()
+}
+
+//salt is Hi() from rfc 5802, i.e. pbkdf2 with a single block
+func (m *saslScram) salt(salt []byte, iter int) []byte {
+	h := hmac.New(m.hash, []byte(m.pass))
+	h.Write(salt)
+	h.Write([]byte{0, 0, 0, 1})
+	u := h.Sum()
+	ret := make([]byte, len(u))
+	copy(ret, u)
+	for i := 1; i < iter; i++ {
+		h.Reset()
+		h.Write(u)
+		u = h.Sum()
+		for j := range ret {
+			ret[j] ^= u[j]
+		}
+	}
+	return ret
+}
+
+func b64(data []byte) string {
+	enc := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(enc, data)
+	return string(enc)
+}
+
+func unb64(data string) ([]byte, os.Error) {
+	dec := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	l, err := base64.StdEncoding.Decode(dec, []byte(data))
+	if err != nil {
+		return nil, err
+	}
+	return dec[:l], nil
+}
+
+//scramAttrs splits a scram message like "r=abc,s=xyz,i=4096"
+func scramAttrs(msg string) map[string]string {
+	ret := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",", -1) {
+		if len(attr) > 1 && attr[1] == '=' {
+			ret[attr[:1]] = attr[2:]
+		}
+	}
+	return ret
+}
+
+//Next runs one step of the exchange, an empty challenge starts it over
+func (m *saslScram) Next(challenge []byte) ([]byte, os.Error) {
+	if len(challenge) == 0 {
+		m.step = 0
+		m.verified = false
+	}
+	switch m.step {
+	case 0:
+		nonce := make([]byte, 18)
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		m.nonce = b64(nonce)
+		user := strings.Replace(strings.Replace(m.user, "=", "=3D", -1), ",", "=2C", -1)
+		m.clientFirstBare = fmt.Sprintf("n=%s,r=%s", user, m.nonce)
+		m.step++
+		return []byte("n,," + m.clientFirstBare), nil
+	case 1:
+		serverFirst := string(challenge)
+		attrs := scramAttrs(serverFirst)
+		if _, ok := attrs["m"]; ok {
+			return nil, os.NewError("Unsupported scram extension")
+		}
+		if !strings.HasPrefix(attrs["r"], m.nonce) {
+			return nil, os.NewError("Server nonce doesn't start with ours")
+		}
+		salt, err := unb64(attrs["s"])
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("Bad scram salt: %s", err.String()))
+		}
+		iter, err := strconv.Atoi(attrs["i"])
+		if err != nil || iter < 1 {
+			return nil, os.NewError(fmt.Sprintf("Bad scram iteration count: %s", attrs["i"]))
+		}
+		salted := m.salt(salt, iter)
+		clientKey := m.hmac(salted, "Client Key")
+		h := m.hash()
+		h.Write(clientKey)
+		storedKey := h.Sum()
+		withoutProof := "c=biws,r=" + attrs["r"] //biws is "n,," in base64
+		authMessage := strings.Join([]string{m.clientFirstBare, serverFirst, withoutProof}, ",")
+		proof := m.hmac(storedKey, authMessage)
+		for i := range proof {
+			proof[i] ^= clientKey[i]
+		}
+		m.serverSignature = m.hmac(m.hmac(salted, "Server Key"), authMessage)
+		m.step++
+		return []byte(withoutProof + ",p=" + b64(proof)), nil
+	case 2:
+		attrs := scramAttrs(string(challenge))
+		if e, ok := attrs["e"]; ok {
+			return nil, os.NewError(fmt.Sprintf("Scram error from server: %s", e))
+		}
+		if attrs["v"] != b64(m.serverSignature) {
+			return nil, os.NewError("Bad scram server signature")
+		}
+		m.verified = true
+		m.step++
+		return []byte{}, nil
+	}
+	return nil, os.NewError("Unexpected scram challenge")
+}
+
+//saslVerifier is implemented by mechanisms which authenticate the server too,
+//success is only trusted once the server has been verified
+type saslVerifier interface {
+	Verified() bool
+}
+
+//mechanism strength, the strongest mechanism offered by the server is used
+var saslStrength = map[string]int{
+	"PLAIN":         1,
+	"SCRAM-SHA-1":   2,
+	"SCRAM-SHA-256": 3,
+	"EXTERNAL":      4,
+}
+
+//pickSasl returns the strongest usable mechanism from offered (nil when we
+//don't know what the server offers) which wasn't tried yet
+func (n *Network) pickSasl(offered []string, tried map[string]bool) SaslMechanism {
+	var best SaslMechanism
+	for _, m := range n.saslmechs {
+		if tried[m.Name()] {
+			continue
+		}
+		if n.saslimplicit && !n.conn.Secure() {
+			continue //like IDENTIFY, never sent in the clear
+		}
+		if _, ok := m.(*saslExternal); ok {
+			if lt, ok := n.conn.(*lineTransport); !ok || !lt.secure {
+				continue //we only present our client certificate on tls connections
+			}
+		}
+		if offered != nil {
+			found := false
+			for _, o := range offered {
+				if strings.ToUpper(o) == m.Name() {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		if best == nil || saslStrength[m.Name()] > saslStrength[best.Name()] {
+			best = m
+		}
+	}
+	return best
+}
+
+//SetSasl enables sasl authentication during registration. The strongest of
+//the given mechanisms the server offers is used; policy is SASLCONTINUE or
+//SASLABORT.
+func (n *Network) SetSasl(policy int, mechs ...SaslMechanism) {
+	n.saslmechs = mechs
+	n.saslimplicit = false
+	n.saslpolicy = policy
+	n.RequestCaps("sasl")
+}
+
+//GetAccount returns the account we're logged in as, if any
+func (n *Network) GetAccount() string {
+	return n.account
+}
+
+//authSend sends a sasl response, base64 encoded and split in chunks
+func (n *Network) authSend(resp []byte) {
+	if len(resp) == 0 {
+		n.queueOut <- &IrcMessage{"", "AUTHENTICATE", []string{"+"}, nil}
+		return
+	}
+	enc := b64(resp)
+	for len(enc) >= saslChunk {
+		n.queueOut <- &IrcMessage{"", "AUTHENTICATE", []string{enc[:saslChunk]}, nil}
+		enc = enc[saslChunk:]
+	}
+	if len(enc) > 0 {
+		n.queueOut <- &IrcMessage{"", "AUTHENTICATE", []string{enc}, nil}
+	} else { //the last chunk was full, tell the server we're done
+		n.queueOut <- &IrcMessage{"", "AUTHENTICATE", []string{"+"}, nil}
+	}
+}
+
+//authenticate runs the sasl exchange, it must be called between CAP REQ and
+//CAP END. If the server rejects a mechanism and lists its own (908), the
+//strongest of those we have is tried next, but on plain-text connections a
+//mechanism verifying the server is never followed by one that doesn't.
+func (n *Network) authenticate() os.Error {
+	if len(n.saslmechs) == 0 {
+		return nil
+	}
+	if !n.CapEnabled("sasl") {
+		return os.NewError("Server doesn't support sasl")
+	}
+	var offered []string
+	if v, _ := n.caps.value("sasl"); v != "" {
+		offered = strings.Split(v, ",", -1)
+	}
+	tried := make(map[string]bool)
+	mech := n.pickSasl(offered, tried)
+	if mech == nil {
+		return os.NewError("Server offers none of our sasl mechanisms")
+	}
+	myreplies := []string{"RPL_LOGGEDIN", "ERR_NICKLOCKED", "RPL_SASLSUCCESS", "ERR_SASLFAIL",
+		"ERR_SASLTOOLONG", "ERR_SASLABORTED", "ERR_SASLALREADY", "RPL_SASLMECHS", "AUTHENTICATE"}
+	repch := make(chan *IrcMessage, 10)
+	sub, err := n.Listen.RegListener(replyCodes(myreplies...), repch)
+	if err != nil {
+		return os.NewError(fmt.Sprintf("Couldn't register listeners for sasl: %s", err.String()))
+	}
+	defer sub.Close()
+	ticker := time.NewTicker(n.timeout())
+	tried[mech.Name()] = true
+	n.queueOut <- &IrcMessage{"", "AUTHENTICATE", []string{mech.Name()}, nil}
+	listed := false //the server told us its mechanisms since the last attempt
+	challenge := bytes.NewBufferString("")
+	for {
+		select {
+		case msg := <-repch:
+			switch msg.Cmd {
+			case "AUTHENTICATE":
+				if len(msg.Params) < 1 {
+					continue
+				}
+				if msg.Params[0] != "+" {
+					challenge.WriteString(msg.Params[0])
+					if len(msg.Params[0]) == saslChunk { //more chunks follow
+						break
+					}
+				}
+				data, err := unb64(challenge.String())
+				challenge.Reset()
+				if err != nil {
+					n.queueOut <- &IrcMessage{"", "AUTHENTICATE", []string{"*"}, nil}
+					ticker.Stop()
+					return os.NewError(fmt.Sprintf("Bad sasl challenge: %s", err.String()))
+				}
+				resp, err := mech.Next(data)
+				if err != nil {
+					n.queueOut <- &IrcMessage{"", "AUTHENTICATE", []string{"*"}, nil}
+					ticker.Stop()
+					return err
+				}
+				n.authSend(resp)
+			case replies["RPL_LOGGEDIN"]:
+				if len(msg.Params) > 2 {
+					n.account = msg.Params[2]
+				}
+			case replies["RPL_SASLMECHS"]:
+				if len(msg.Params) > 1 {
+					offered = strings.Split(msg.Params[1], ",", -1)
+					listed = true
+				}
+			case replies["RPL_SASLSUCCESS"], replies["ERR_SASLALREADY"]:
+				ticker.Stop()
+				if v, ok := mech.(saslVerifier); ok && !v.Verified() && msg.Cmd == replies["RPL_SASLSUCCESS"] {
+					return os.NewError(fmt.Sprintf("Server didn't prove its identity with %s", mech.Name()))
+				}
+				return nil
+			case replies["ERR_SASLFAIL"]:
+				next := n.pickSasl(offered, tried)
+				if _, ok := mech.(saslVerifier); ok && next != nil && !n.conn.Secure() {
+					if _, ok := next.(saslVerifier); !ok {
+						next = nil //the failure may be forged to get the password in the clear
+					}
+				}
+				if listed && next != nil {
+					listed = false
+					mech = next
+					tried[mech.Name()] = true
+					challenge.Reset()
+					n.queueOut <- &IrcMessage{"", "AUTHENTICATE", []string{mech.Name()}, nil}
+					break
+				}
+				ticker.Stop()
+				return os.NewError("ERR_SASLFAIL")
+			default:
+				for key, _ := range replies {
+					if replies[key] == msg.Cmd && key[:3] == "ERR" {
+						ticker.Stop()
+						return os.NewError(key)
+					}
+				}
+			}
+			ticker.Stop()
+			ticker = time.NewTicker(n.timeout())
+		case <-ticker.C:
+			ticker.Stop()
+			n.queueOut <- &IrcMessage{"", "AUTHENTICATE", []string{"*"}, nil}
+			return os.NewError("Timeout during sasl authentication")
+		}
+	}
+	ticker.Stop()
+	return nil
+}
@@ -0,0 +1,122 @@
+package ircchans
+
+import (
+	"os"
+	"testing"
+)
+
+type scramVector struct {
+	mech                                         *saslScram
+	nonce, serverFirst, clientFinal, serverFinal string
+}
+
+//the example exchanges of rfc 5802 and rfc 7677
+var scramVectors = []scramVector{
+	{SaslScramSha1("user", "pencil").(*saslScram), "fyko+d2lbbFgONRv9qkxdawL",
+		"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		"v=rmF9pqV8S7suAoZWja4dJRkFsKQ="},
+	{SaslScramSha256("user", "pencil").(*saslScram), "rOprNGfwEbeRWgbNEkqO",
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="},
+}
+
+//startScram begins the exchange and swaps our random nonce for the example's
+func startScram(t *testing.T, v scramVector) {
+	first, err := v.mech.Next(nil)
+	if err != nil {
+		t.Fatalf("%s: %s", v.mech.Name(), err.String())
+	}
+	if string(first) != "n,,n=user,r="+v.mech.nonce {
+		t.Errorf("%s: bad client first message %s", v.mech.Name(), first)
+	}
+	v.mech.nonce = v.nonce
+	v.mech.clientFirstBare = "n=user,r=" + v.nonce
+}
+
+func TestScram(t *testing.T) {
+	for _, v := range scramVectors {
+		startScram(t, v)
+		final, err := v.mech.Next([]byte(v.serverFirst))
+		if err != nil {
+			t.Fatalf("%s: %s", v.mech.Name(), err.String())
+		}
+		if string(final) != v.clientFinal {
+			t.Errorf("%s: got %s, expected %s", v.mech.Name(), final, v.clientFinal)
+		}
+		if _, err := v.mech.Next([]byte(v.serverFinal)); err != nil || !v.mech.Verified() {
+			t.Errorf("%s: server signature not verified: %v", v.mech.Name(), err)
+		}
+	}
+}
+
+func TestScramBadServer(t *testing.T) {
+	v := scramVectors[1]
+	startScram(t, v)
+	v.mech.Next([]byte(v.serverFirst))
+	if _, err := v.mech.Next([]byte("v=rmF9pqV8S7suAoZWja4dJRkFsKQ=")); err == nil || v.mech.Verified() {
+		t.Errorf("Bad server signature accepted")
+	}
+	startScram(t, v)
+	if _, err := v.mech.Next([]byte("r=someoneelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")); err == nil {
+		t.Errorf("Server nonce not starting with ours accepted")
+	}
+}
+
+func TestSaslPlain(t *testing.T) {
+	resp, _ := SaslPlain("user", "pencil").Next(nil)
+	if string(resp) != "\x00user\x00pencil" {
+		t.Errorf("Bad PLAIN response: %q", resp)
+	}
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	n.authSend(resp)
+	if msg := <-n.queueOut; msg.Params[0] != "AHVzZXIAcGVuY2ls" {
+		t.Errorf("Bad PLAIN encoding: %s", msg.String())
+	}
+	n.authSend(make([]byte, saslChunk/4*3)) //exactly one chunk once encoded
+	if msg := <-n.queueOut; len(msg.Params[0]) != saslChunk {
+		t.Errorf("Bad chunk: %s", msg.String())
+	}
+	if msg := <-n.queueOut; msg.Params[0] != "+" {
+		t.Errorf("Full last chunk not followed by +: %s", msg.String())
+	}
+}
+
+func TestSaslExternal(t *testing.T) {
+	resp, _ := SaslExternal().Next(nil)
+	if len(resp) != 0 {
+		t.Errorf("Bad EXTERNAL response: %q", resp)
+	}
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	n.authSend(resp)
+	if msg := <-n.queueOut; msg.Params[0] != "+" {
+		t.Errorf("Empty response not sent as +: %s", msg.String())
+	}
+}
+
+func TestScramNoDowngrade(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	n.lags.add(1)
+	n.conn = &lineTransport{} //plain-text
+	n.SetSasl(SASLABORT, SaslScramSha256("user", "pencil"), SaslPlain("user", "pencil"))
+	n.caps.apply("LS", "sasl=SCRAM-SHA-256,PLAIN")
+	n.caps.apply("ACK", "sasl")
+	errch := make(chan os.Error, 1)
+	go func() {
+		errch <- n.authenticate()
+	}()
+	if msg := <-n.queueOut; msg.Cmd != "AUTHENTICATE" || msg.Params[0] != "SCRAM-SHA-256" {
+		t.Fatalf("Started with %s", msg.String())
+	}
+	n.Listen.dispatch(IrcMessage{"server", "908", []string{"me", "PLAIN", "are available SASL mechanisms"}, nil})
+	n.Listen.dispatch(IrcMessage{"server", "904", []string{"me", "SASL authentication failed"}, nil})
+	if err := <-errch; err == nil {
+		t.Errorf("Authenticated after the failure")
+	}
+	for len(n.queueOut) > 0 {
+		if msg := <-n.queueOut; msg.Params[0] == "PLAIN" {
+			t.Errorf("Fell back to PLAIN on a plain-text connection")
+		}
+	}
+}
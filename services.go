@@ -0,0 +1,305 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+//notices of the common services packages (atheme, anope) when identifying.
+//Patterns are matched against the notice in lower case.
+var (
+	DefaultIdentifySuccess = []string{"you are now identified", "password accepted", "you are now logged in"}
+	DefaultIdentifyFailure = []string{"invalid password", "password incorrect", "not a registered nickname", "isn't registered", "not registered"}
+)
+
+//identifyWait is how long the auto-joins wait for us to be identified
+const identifyWait = second * 30
+
+type servicesState struct {
+	lock       *sync.Mutex
+	nickserv   string
+	chanserv   string
+	account    string //empty to identify for the current nick
+	password   string
+	success    []*regexp.Regexp
+	failure    []*regexp.Regexp
+	identified bool
+	waiting    chan bool //closed once identified
+	autojoin   []string
+	keys       []string
+	joinwait   bool //delay the auto-joins until we're identified
+}
+
+func newServicesState() *servicesState {
+	s := &servicesState{lock: new(sync.Mutex), nickserv: "NickServ", chanserv: "ChanServ", waiting: make(chan bool)}
+	s.success, _ = compilePatterns(DefaultIdentifySuccess)
+	s.failure, _ = compilePatterns(DefaultIdentifyFailure)
+	return s
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, os.Error) {
+	ret := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("Bad pattern %s: %s", p, err.String()))
+		}
+		ret = append(ret, re)
+	}
+	return ret, nil
+}
+
+func matchAny(res []*regexp.Regexp, text string) bool {
+	for _, re := range res {
+		if re.MatchString(strings.ToLower(text)) {
+			return true
+		}
+	}
+	return false
+}
+
+//setIdentified updates the state and wakes up the ones waiting for it
+func (s *servicesState) setIdentified(identified bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if identified == s.identified {
+		return
+	}
+	s.identified = identified
+	if identified {
+		close(s.waiting)
+	} else {
+		s.waiting = make(chan bool)
+	}
+}
+
+//SetIdentify sets the credentials used with NickServ after registration. An
+//empty account identifies for the current nick. Unless other sasl mechanisms
+//were set, sasl PLAIN is tried first with the same credentials (the account
+//defaults to the preferred nick), and IDENTIFY is only sent when that failed.
+//The password is only ever sent on tls connections.
+func (n *Network) SetIdentify(account, password string) {
+	n.services.lock.Lock()
+	n.services.account = account
+	n.services.password = password
+	n.services.lock.Unlock()
+	if (len(n.saslmechs) == 0 || n.saslimplicit) && password != "" {
+		if account == "" {
+			account = n.GetPreferredNick()
+		}
+		n.SetSasl(SASLCONTINUE, SaslPlain(account, password))
+		n.saslimplicit = true
+	}
+}
+
+//SetServicesNames changes the nicks of NickServ and ChanServ for networks
+//naming them differently
+func (n *Network) SetServicesNames(nickserv, chanserv string) {
+	n.services.lock.Lock()
+	defer n.services.lock.Unlock()
+	n.services.nickserv = nickserv
+	n.services.chanserv = chanserv
+}
+
+//SetIdentifyPatterns replaces the regular expressions recognising the NickServ
+//notices telling whether identification succeeded or failed. They're matched
+//against the notice in lower case.
+func (n *Network) SetIdentifyPatterns(success, failure []string) os.Error {
+	s, err := compilePatterns(success)
+	if err != nil {
+		return err
+	}
+	f, err := compilePatterns(failure)
+	if err != nil {
+		return err
+	}
+	n.services.lock.Lock()
+	defer n.services.lock.Unlock()
+	n.services.success = s
+	n.services.failure = f
+	return nil
+}
+
+//SetAutoJoin sets channels to join after every registration. With
+//waitIdentified they are joined once we're identified, for channels
+//restricted to registered users.
+func (n *Network) SetAutoJoin(chans, keys []string, waitIdentified bool) {
+	n.services.lock.Lock()
+	defer n.services.lock.Unlock()
+	n.services.autojoin = chans
+	n.services.keys = keys
+	n.services.joinwait = waitIdentified
+}
+
+//Identified tells whether we're logged in to services, through sasl or
+//NickServ
+func (n *Network) Identified() bool {
+	n.services.lock.Lock()
+	defer n.services.lock.Unlock()
+	return n.services.identified
+}
+
+//WaitIdentified waits up to timeout nanoseconds to be identified
+func (n *Network) WaitIdentified(timeout int64) bool {
+	n.services.lock.Lock()
+	waiting := n.services.waiting
+	n.services.lock.Unlock()
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+	select {
+	case <-waiting:
+	case <-ticker.C:
+		return false
+	}
+	return true
+}
+
+//Identify sends IDENTIFY to NickServ and waits for a notice telling whether it
+//worked. Nothing is sent when we're already logged in, or on a plain-text
+//connection.
+func (n *Network) Identify() os.Error {
+	if n.Identified() {
+		return nil
+	}
+	if n.conn != nil && !n.conn.Secure() {
+		return os.NewError("Won't identify on a plain-text connection, the password would be sent in the clear")
+	}
+	n.services.lock.Lock()
+	nickserv, account, password := n.services.nickserv, n.services.account, n.services.password
+	success, failure := n.services.success, n.services.failure
+	n.services.lock.Unlock()
+	if password == "" {
+		return os.NewError("No password to identify with")
+	}
+	repch := make(chan *IrcMessage, 10)
+	sub, err := n.Listen.RegListener([]string{"NOTICE"}, repch)
+	if err != nil {
+		return os.NewError(fmt.Sprintf("Couldn't register listener for NOTICE: %s", err.String()))
+	}
+	defer sub.Close()
+	ticker := time.NewTicker(n.timeout() * 2) //services can be slower than the server
+	defer ticker.Stop()
+	text := "IDENTIFY " + password
+	if account != "" {
+		text = fmt.Sprintf("IDENTIFY %s %s", account, password)
+	}
+	if err := n.Privmsg([]string{nickserv}, text); err != nil {
+		return os.NewError(fmt.Sprintf("Couldn't identify to %s: %s", nickserv, err.String()))
+	}
+	isupport := n.isupport.get()
+	for {
+		select {
+		case msg := <-repch:
+			if len(msg.Params) < 2 || isupport.Fold(strings.Split(msg.Prefix, "!", 2)[0]) != isupport.Fold(nickserv) {
+				continue
+			}
+			if matchAny(success, msg.Params[1]) {
+				n.services.setIdentified(true)
+				return nil
+			}
+			if matchAny(failure, msg.Params[1]) {
+				return os.NewError(fmt.Sprintf("Identification failed: %s", msg.Params[1]))
+			}
+		case <-ticker.C:
+			return os.NewError(fmt.Sprintf("No reply from %s", nickserv))
+		}
+	}
+	return nil
+}
+
+//chanserv sends a command to ChanServ
+func (n *Network) chanserv(params ...string) os.Error {
+	n.services.lock.Lock()
+	chanserv := n.services.chanserv
+	n.services.lock.Unlock()
+	return n.Privmsg([]string{chanserv}, strings.Join(params, " "))
+}
+
+//ChanServOp asks ChanServ to op nick, or us if nick is empty, on ch
+func (n *Network) ChanServOp(ch, nick string) os.Error {
+	if nick == "" {
+		nick = n.GetNick()
+	}
+	return n.chanserv("OP", ch, nick)
+}
+
+//ChanServInvite asks ChanServ to invite us to ch
+func (n *Network) ChanServInvite(ch string) os.Error {
+	return n.chanserv("INVITE", ch)
+}
+
+//ChanServUnban asks ChanServ to lift the bans matching us on ch
+func (n *Network) ChanServUnban(ch string) os.Error {
+	return n.chanserv("UNBAN", ch)
+}
+
+//afterRegistration identifies unless sasl logged us in, and joins the
+//auto-join channels
+func (n *Network) afterRegistration() {
+	n.services.lock.Lock()
+	password, chans, keys, joinwait := n.services.password, n.services.autojoin, n.services.keys, n.services.joinwait
+	n.services.lock.Unlock()
+	if password != "" {
+		if err := n.Identify(); err != nil {
+			n.l.Printf("Couldn't identify: %s", err.String())
+		}
+	}
+	if len(chans) == 0 {
+		return
+	}
+	if joinwait && !n.WaitIdentified(identifyWait) {
+		n.l.Printf("Not identified, not joining %s", strings.Join(chans, ","))
+		return
+	}
+	if err := n.Join(chans, keys); err != nil {
+		n.l.Printf("Couldn't join %s: %s", strings.Join(chans, ","), err.String())
+	}
+}
+
+//serviceser follows our login state: sasl and services announce logins and
+//logouts with RPL_LOGGEDIN and RPL_LOGGEDOUT, NickServ with notices
+func (n *Network) serviceser(quit chan bool) {
+	ch := make(chan *IrcMessage, internalBuffer)
+	cmds := []string{replies["RPL_LOGGEDIN"], replies["RPL_LOGGEDOUT"], replies["RPL_ENDOFMOTD"], replies["ERR_NOMOTD"], "NOTICE"}
+	sub, _ := n.Listen.RegListener(cmds, ch)
+	defer sub.Close()
+	registered := false
+	for {
+		var msg *IrcMessage
+		select {
+		case msg = <-ch:
+		case <-quit:
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.Cmd {
+		case replies["RPL_LOGGEDIN"]:
+			n.services.setIdentified(true)
+		case replies["RPL_LOGGEDOUT"]:
+			n.services.setIdentified(false)
+		case replies["RPL_ENDOFMOTD"], replies["ERR_NOMOTD"]:
+			if !registered {
+				registered = true
+				go n.afterRegistration()
+			}
+		case "NOTICE":
+			if len(msg.Params) < 2 {
+				continue
+			}
+			n.services.lock.Lock()
+			nickserv, success := n.services.nickserv, n.services.success
+			n.services.lock.Unlock()
+			isupport := n.isupport.get()
+			if isupport.Fold(strings.Split(msg.Prefix, "!", 2)[0]) == isupport.Fold(nickserv) && matchAny(success, msg.Params[1]) {
+				n.services.setIdentified(true)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,93 @@
+package ircchans
+
+import (
+	"os"
+	"testing"
+	"strings"
+	"time"
+)
+
+//servicesNetwork returns a network answering quickly, commands stay in the
+//write queue
+func servicesNetwork() *Network {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	n.lags.add(1) //minimal timeouts
+	return n
+}
+
+//nextOut returns the next queued message, or nil after a second
+func nextOut(n *Network) *IrcMessage {
+	ticker := time.NewTicker(second)
+	defer ticker.Stop()
+	select {
+	case msg := <-n.queueOut:
+		return msg
+	case <-ticker.C:
+	}
+	return nil
+}
+
+func TestIdentify(t *testing.T) {
+	n := servicesNetwork()
+	n.SetIdentify("", "secret")
+	for _, reply := range []string{"Password accepted - you are now recognized.", "Invalid password for me."} {
+		n.services.setIdentified(false)
+		errch := make(chan os.Error, 1)
+		go func() {
+			errch <- n.Identify()
+		}()
+		if msg := nextOut(n); msg == nil || msg.Cmd != "PRIVMSG" || msg.Params[0] != "NickServ" || msg.Params[1] != "IDENTIFY secret" {
+			t.Fatalf("Bad IDENTIFY: %s", msg)
+		}
+		n.Listen.dispatch(IrcMessage{"NickServ!s@services", "NOTICE", []string{"me", reply}, nil})
+		err := <-errch
+		if strings.HasPrefix(reply, "Password") && (err != nil || !n.Identified()) {
+			t.Errorf("Not identified after %s", reply)
+		} else if strings.HasPrefix(reply, "Invalid") && (err == nil || n.Identified()) {
+			t.Errorf("Identified after %s", reply)
+		}
+	}
+}
+
+func TestJoinWait(t *testing.T) {
+	n := servicesNetwork()
+	n.SetAutoJoin([]string{"#registered"}, nil, true)
+	go n.afterRegistration()
+	if msg := nextOut(n); msg != nil {
+		t.Fatalf("Joined before being identified: %s", msg)
+	}
+	n.services.setIdentified(true)
+	if msg := nextOut(n); msg == nil || msg.Cmd != "JOIN" || msg.Params[0] != "#registered" {
+		t.Errorf("Didn't join once identified: %s", msg)
+	}
+}
+
+func TestChanServ(t *testing.T) {
+	n := servicesNetwork()
+	n.SetServicesNames("NickServ", "CS")
+	go n.ChanServOp("#chan", "")
+	if msg := nextOut(n); msg == nil || msg.Params[0] != "CS" || msg.Params[1] != "OP #chan me" {
+		t.Errorf("Bad op request: %s", msg)
+	}
+	go n.ChanServUnban("#chan")
+	if msg := nextOut(n); msg == nil || msg.Params[0] != "CS" || msg.Params[1] != "UNBAN #chan" {
+		t.Errorf("Bad unban request: %s", msg)
+	}
+}
+
+func TestIdentifySasl(t *testing.T) {
+	n := servicesNetwork()
+	n.SetIdentify("acct", "secret")
+	n.conn = &lineTransport{secure: false}
+	if m := n.pickSasl(nil, map[string]bool{}); m != nil {
+		t.Errorf("Implicit sasl PLAIN used on a plain-text connection")
+	}
+	if err := n.Identify(); err == nil || len(n.queueOut) > 0 {
+		t.Errorf("IDENTIFY sent on a plain-text connection")
+	}
+	n.conn = &lineTransport{secure: true}
+	if m := n.pickSasl(nil, map[string]bool{}); m == nil || m.Name() != "PLAIN" {
+		t.Errorf("Implicit sasl PLAIN not used on a tls connection")
+	}
+	n.conn = nil
+}
@@ -0,0 +1,180 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"json"
+	"io/ioutil"
+	"strings"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//StsPolicy is an ircv3 strict transport security policy: the host must only
+//be reached using tls on Port.
+type StsPolicy struct {
+	Port    string
+	Expires int64 //seconds since the epoch, ignored for preloaded policies
+	Preload bool
+}
+
+type stsStore struct {
+	lock     *sync.Mutex
+	file     string
+	loaded   bool
+	policies map[string]*StsPolicy
+}
+
+var (
+	stsPolicies   = &stsStore{new(sync.Mutex), confdir + "/sts.json", false, make(map[string]*StsPolicy)}
+	errStsUpgrade = os.NewError("Server requires a tls connection")
+)
+
+//load reads the persistent policies, the caller must hold the lock
+func (s *stsStore) load() {
+	if s.loaded {
+		return
+	}
+	s.loaded = true
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return
+	}
+	policies := make(map[string]*StsPolicy)
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return
+	}
+	for host, p := range policies {
+		if _, ok := s.policies[host]; !ok {
+			s.policies[host] = p
+		}
+	}
+}
+
+//save writes the learned policies, the caller must hold the lock
+func (s *stsStore) save() os.Error {
+	learned := make(map[string]*StsPolicy)
+	for host, p := range s.policies {
+		if !p.Preload {
+			learned[host] = p
+		}
+	}
+	data, err := json.Marshal(learned)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.file, data, 0600); err != nil {
+		return os.NewError(fmt.Sprintf("Couldn't save sts policies to %s: %s", s.file, err.String()))
+	}
+	return nil
+}
+
+func (s *stsStore) get(host string) (*StsPolicy, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.load()
+	p, ok := s.policies[host]
+	if !ok {
+		return nil, false
+	}
+	if !p.Preload && p.Expires < time.Seconds() {
+		s.policies[host] = nil, false
+		s.save()
+		return nil, false
+	}
+	return p, true
+}
+
+func (s *stsStore) set(host string, p *StsPolicy) os.Error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.load()
+	if old, ok := s.policies[host]; ok && old.Preload && !p.Preload {
+		return nil //preloaded policies are never replaced by learned ones
+	}
+	s.policies[host] = p
+	if p.Preload {
+		return nil
+	}
+	return s.save()
+}
+
+func (s *stsStore) del(host string) os.Error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.load()
+	if p, ok := s.policies[host]; !ok || p.Preload {
+		return nil
+	}
+	s.policies[host] = nil, false
+	return s.save()
+}
+
+//StsPreload makes every connection to host use tls on port, as if the host
+//was on a preload list. Preloaded policies never expire and aren't saved.
+func StsPreload(host, port string) {
+	stsPolicies.set(host, &StsPolicy{port, 0, true})
+}
+
+//GetStsPolicy returns the policy in effect for host, if any
+func GetStsPolicy(host string) (StsPolicy, bool) {
+	p, ok := stsPolicies.get(host)
+	if !ok {
+		return StsPolicy{}, false
+	}
+	return *p, true
+}
+
+//parseCapValue splits a capability value like "port=6697,duration=300"
+func parseCapValue(value string) map[string]string {
+	ret := make(map[string]string)
+	for _, kv := range strings.Split(value, ",", -1) {
+		if kv == "" {
+			continue
+		}
+		if i := strings.Index(kv, "="); i > -1 {
+			ret[kv[:i]] = kv[i+1:]
+		} else {
+			ret[kv] = ""
+		}
+	}
+	return ret
+}
+
+//sts applies the sts capability value advertised by the server. On plain-text
+//connections it returns errStsUpgrade when we have to reconnect using tls, on
+//secure connections it records or clears the persistent policy. Websockets
+//are left alone, the policy's port isn't a websocket endpoint.
+func (n *Network) sts(value string) os.Error {
+	if _, ok := n.conn.(*wsTransport); ok {
+		return nil
+	}
+	params := parseCapValue(value)
+	if !n.conn.Secure() {
+		port, ok := params["port"]
+		if !ok || port == "" {
+			return nil
+		}
+		n.stsport = port
+		return errStsUpgrade
+	}
+	duration, ok := params["duration"]
+	if !ok {
+		return nil
+	}
+	d, err := strconv.Atoi64(duration)
+	if err != nil || d < 0 {
+		n.l.Printf("Ignoring bad sts duration: %s", value)
+		return nil
+	}
+	if d == 0 {
+		return stsPolicies.del(n.network)
+	}
+	port := n.port
+	addr := n.conn.RemoteAddr().String()
+	if i := strings.LastIndex(addr, ":"); i > -1 {
+		port = addr[i+1:]
+	}
+	return stsPolicies.set(n.network, &StsPolicy{port, time.Seconds() + d, false})
+}
@@ -0,0 +1,220 @@
+package ircchans
+
+import (
+	"os"
+	"net"
+	"fmt"
+	"http"
+	"strings"
+	"bufio"
+	"websocket"
+)
+
+const (
+	WSTEXT   = "text.ircv3.net"   //websocket subprotocol carrying utf-8 lines
+	WSBINARY = "binary.ircv3.net" //websocket subprotocol carrying raw lines
+)
+
+//transport carries whole irc lines, without the trailing \r\n, between us and
+//the server
+type transport interface {
+	ReadLine() (string, os.Error)
+	WriteLine(line string) os.Error
+	Close() os.Error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Secure() bool
+}
+
+//lineTransport is the classic irc stream, lines terminated by \r\n
+type lineTransport struct {
+	conn   net.Conn
+	buf    *bufio.ReadWriter
+	secure bool
+}
+
+func newLineTransport(conn net.Conn, secure bool) *lineTransport {
+	return &lineTransport{conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), secure}
+}
+
+func (t *lineTransport) ReadLine() (string, os.Error) {
+	l, err := t.buf.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(l, "\r\n"), nil
+}
+
+func (t *lineTransport) WriteLine(line string) os.Error {
+	if _, err := t.buf.WriteString(fmt.Sprintf("%s\r\n", line)); err != nil {
+		return err
+	}
+	return t.buf.Flush()
+}
+
+func (t *lineTransport) Close() os.Error {
+	return t.conn.Close()
+}
+
+func (t *lineTransport) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+func (t *lineTransport) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+func (t *lineTransport) Secure() bool {
+	return t.secure
+}
+
+//wsTransport sends one irc line per websocket frame, as specified by ircv3
+type wsTransport struct {
+	ws     *websocket.Conn
+	buf    []byte
+	secure bool
+}
+
+func dialWebsocket(url, protocol, origin string) (*wsTransport, os.Error) {
+	ws, err := websocket.Dial(url, protocol, origin)
+	if err != nil {
+		return nil, err
+	}
+	if protocol == WSBINARY { //lines needn't be utf-8, they go in binary frames
+		ws.PayloadType = websocket.BinaryFrame
+	}
+	//8191 bytes of tags + 512 bytes of message fit in a frame
+	return &wsTransport{ws, make([]byte, 8192), strings.HasPrefix(url, "wss:")}, nil
+}
+
+func (t *wsTransport) ReadLine() (string, os.Error) {
+	n, err := t.ws.Read(t.buf)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(t.buf[:n]), "\r\n"), nil
+}
+
+//WriteLine sends line in a frame of its own, without a line terminator. A line
+//break inside it would be a second message in the same frame, so it's refused.
+func (t *wsTransport) WriteLine(line string) os.Error {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.IndexAny(line, "\r\n") > -1 {
+		return os.NewError(fmt.Sprintf("Line break in websocket message: %q", line))
+	}
+	_, err := t.ws.Write([]byte(line))
+	return err
+}
+
+func (t *wsTransport) Close() os.Error {
+	return t.ws.Close()
+}
+
+func (t *wsTransport) LocalAddr() net.Addr {
+	return t.ws.LocalAddr()
+}
+
+func (t *wsTransport) RemoteAddr() net.Addr {
+	return t.ws.RemoteAddr()
+}
+
+func (t *wsTransport) Secure() bool {
+	return t.secure
+}
+
+//SetURL selects the server and the transport from an irc://, ircs://, ws:// or
+//wss:// url. It takes effect on the next Connect.
+func (n *Network) SetURL(rawurl string) os.Error {
+	u, err := http.ParseURL(rawurl)
+	if err != nil {
+		return os.NewError(fmt.Sprintf("Bad url %s: %s", rawurl, err.String()))
+	}
+	host, port := u.Host, ""
+	if i := strings.LastIndex(host, ":"); i > -1 && i > strings.LastIndex(host, "]") {
+		host, port = u.Host[:i], u.Host[i+1:]
+	}
+	if host == "" {
+		return os.NewError(fmt.Sprintf("No host in url %s", rawurl))
+	}
+	if port == "" {
+		switch u.Scheme {
+		case "irc":
+			port = "6667"
+		case "ircs":
+			port = "6697"
+		case "ws":
+			port = "80"
+		case "wss":
+			port = "443"
+		}
+	}
+	switch u.Scheme {
+	case "irc", "ircs", "ws", "wss":
+	default:
+		return os.NewError(fmt.Sprintf("Unknown url scheme %s", u.Scheme))
+	}
+	n.scheme = u.Scheme
+	n.network = host
+	n.port = port
+	n.wspath = u.Path
+	if u.RawQuery != "" {
+		n.wspath += "?" + u.RawQuery
+	}
+	return nil
+}
+
+//SetWebsocketProtocol chooses the websocket subprotocol, WSTEXT (the default)
+//or WSBINARY
+func (n *Network) SetWebsocketProtocol(protocol string) {
+	n.wsprotocol = protocol
+}
+
+//dial opens a transport according to the scheme set by SetURL. Without a
+//scheme, tls is tried first and plain-text is used as a fallback. A strict
+//transport security policy for the host forces tls on the policy's port. Its
+//port serves irc over tls, so websockets aren't affected.
+func (n *Network) dial() (transport, os.Error) {
+	scheme, port := n.scheme, n.port
+	if scheme == "" || scheme == "irc" {
+		if n.stsport != "" { //only for the reconnection the server asked for
+			scheme, port = "ircs", n.stsport
+			n.stsport = ""
+		} else if p, ok := GetStsPolicy(n.network); ok {
+			scheme, port = "ircs", p.Port
+		}
+	}
+	addr := joinHostPort(n.network, port)
+	switch scheme {
+	case "ws", "wss":
+		path := n.wspath
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		origin := "http://" + addr
+		if scheme == "wss" {
+			origin = "https://" + addr
+		}
+		return dialWebsocket(fmt.Sprintf("%s://%s%s", scheme, addr, path), n.wsprotocol, origin)
+	case "ircs":
+		conn, err := n.dialTLS(n.network, port)
+		if err != nil {
+			return nil, err
+		}
+		return newLineTransport(conn, true), nil
+	case "irc":
+		conn, err := n.dialTCP(n.network, port)
+		if err != nil {
+			return nil, err
+		}
+		return newLineTransport(conn, false), nil
+	}
+	if conn, err := n.dialTLS(n.network, port); err == nil {
+		return newLineTransport(conn, true), nil
+	}
+	n.l.Println("Problem connecting using tls, trying plain-text")
+	conn, err := n.dialTCP(n.network, port)
+	if err != nil {
+		return nil, err
+	}
+	return newLineTransport(conn, false), nil
+}
@@ -0,0 +1,135 @@
+package ircchans
+
+import (
+	"testing"
+	"time"
+	"fmt"
+	"strings"
+	"net"
+	"http"
+	"websocket"
+)
+
+//wsStandin is a tiny irc server speaking one message per websocket frame
+func wsStandin(ws *websocket.Conn) {
+	buf := make([]byte, 8192)
+	nick := "*"
+	for {
+		l, err := ws.Read(buf)
+		if err != nil {
+			return
+		}
+		line := string(buf[:l])
+		if strings.Contains(line, "\n") {
+			ws.Write([]byte(fmt.Sprintf(":standin NOTICE %s :line terminator in frame", nick)))
+			continue
+		}
+		msg, err := PackMsg(line)
+		if err != nil {
+			continue
+		}
+		switch msg.Cmd {
+		case "NICK":
+			nick = msg.Params[0]
+		case "USER":
+			ws.Write([]byte(fmt.Sprintf(":standin 001 %s :Welcome to the websocket stand-in", nick)))
+			ws.Write([]byte(fmt.Sprintf(":standin 376 %s :End of MOTD command", nick)))
+		case "PING":
+			ws.Write([]byte(fmt.Sprintf(":standin PONG standin :%s", msg.Params[0])))
+		case "PRIVMSG":
+			ws.Write([]byte(fmt.Sprintf(":%s!user@standin PRIVMSG %s :%s", nick, msg.Params[0], msg.Params[1])))
+		case "QUIT":
+			return
+		}
+	}
+}
+
+func TestWebsocketTransport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen for websocket stand-in: %s", err.String())
+	}
+	defer l.Close()
+	go http.Serve(l, websocket.Handler(wsStandin))
+
+	n := NewNetwork("", "", "wstest", "wstest", "Websocket test", "", logfile)
+	if err := n.SetURL(fmt.Sprintf("ws://%s/irc", l.Addr().String())); err != nil {
+		t.Fatalf("SetURL error: %s", err.String())
+	}
+	ch := make(chan *IrcMessage, 10)
+	sub, err := n.Listen.RegListener([]string{"*"}, ch)
+	if err != nil {
+		t.Fatalf("Register error: %s", err.String())
+	}
+	defer sub.Close()
+	if err := n.Connect(); err != nil {
+		t.Fatalf("Couldn't connect over websocket: %s", err.String())
+	}
+	go n.Privmsg([]string{"#ws"}, "one message per frame")
+	timeout := time.NewTicker(minute / 2)
+	defer timeout.Stop()
+	for {
+		select {
+		case msg := <-ch:
+			if msg.Cmd == "NOTICE" {
+				t.Errorf("Stand-in complained: %s", msg.Params[1])
+			}
+			if msg.Cmd != "PRIVMSG" {
+				continue
+			}
+			if msg.Params[0] != "#ws" || msg.Params[1] != "one message per frame" {
+				t.Errorf("Websocket error: got %#v back", msg.Params)
+			}
+		case <-timeout.C:
+			t.Fatal("Websocket error: didn't receive our message back")
+		}
+		break
+	}
+	if err := n.Disconnect("Done"); err != nil {
+		t.Errorf("Disconnect error: %s", err.String())
+	}
+}
+
+func TestWebsocketFrames(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen for websocket stand-in: %s", err.String())
+	}
+	defer l.Close()
+	go http.Serve(l, websocket.Handler(wsStandin))
+
+	ws, err := dialWebsocket(fmt.Sprintf("ws://%s/irc", l.Addr().String()), WSBINARY, "http://localhost/")
+	if err != nil {
+		t.Fatalf("Couldn't connect over websocket: %s", err.String())
+	}
+	defer ws.Close()
+	if ws.ws.PayloadType != websocket.BinaryFrame {
+		t.Errorf("Binary subprotocol not using binary frames")
+	}
+	if err := ws.WriteLine("PRIVMSG #ws :two\r\nQUIT"); err == nil {
+		t.Errorf("Sent two messages in a frame")
+	}
+	if err := ws.WriteLine("PING :frame\r\n"); err != nil {
+		t.Fatalf("Write error: %s", err.String())
+	}
+	line, err := ws.ReadLine()
+	if err != nil || line != ":standin PONG standin :frame" {
+		t.Errorf("Line terminator not stripped: got %q back", line)
+	}
+}
+
+func TestStsWebsocket(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	n.conn = &wsTransport{}
+	if err := n.sts("port=6697"); err != nil || n.stsport != "" {
+		t.Errorf("Websocket upgraded to the sts port")
+	}
+	n.SetURL("irc://127.0.0.1:1")
+	n.stsport = "2"
+	if _, err := n.dial(); err == nil {
+		t.Fatalf("Connected to a closed port")
+	}
+	if n.stsport != "" {
+		t.Errorf("Sts port kept after the upgrade")
+	}
+}
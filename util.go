@@ -4,76 +4,64 @@ import (
 	"time"
 )
 
-func (n *Network) pinger() {
-	exch := make(chan bool, 0)
-	err := n.Shutdown.Reg(exch)
-	if err != nil {
-		return
-	}
+func (n *Network) pinger(quit chan bool) {
 	ticker1 := time.NewTicker(minute)
 	defer ticker1.Stop()
 	ticker15 := time.NewTicker(minute * 15)
 	defer ticker15.Stop()
-	tick := make(chan *IrcMessage)
+	tick := make(chan *IrcMessage, internalBuffer)
 	var lastMessage int64
-	n.Listen.RegListener("*", "ticker", tick)
-	defer n.Listen.DelListener("*", "ticker") //close channel and delete listener
+	sub, _ := n.Listen.RegListener([]string{"*"}, tick)
+	defer sub.Close() //close channel and delete listener
 	for {
 		select {
 		case <-ticker1.C:
 			if time.Seconds()-lastMessage >= 60*4 { //ping about every five minutes if there is no activity at all
 				n.Ping()
-				n.l.Printf("Network lag is: %d nanoseconds", n.lag)
+				n.l.Printf("Network lag is: %s", n.Lag())
 			}
 		case <-ticker15.C:
 			//Ping every 15 minutes.
 			n.Ping()
-			n.l.Printf("Network lag is: %d nanoseconds", n.lag)
+			n.l.Printf("Network lag is: %s", n.Lag())
 		case <-tick:
 			lastMessage = time.Seconds()
-		case exit := <-exch:
-			if exit {
-				return
-			}
-			continue
+		case <-quit:
+			return
 		}
 	}
 	return
 }
 
-func (n *Network) ponger() {
-	exch := make(chan bool, 0)
-	err := n.Shutdown.Reg(exch)
-	if err != nil {
-		return
-	}
-	pingch := make(chan *IrcMessage)
-	n.Listen.RegListener("PING", "ponger", pingch)
-	defer n.Listen.DelListener("PING", "ponger")
+func (n *Network) ponger(conn transport, quit chan bool) {
+	pingch := make(chan *IrcMessage, internalBuffer)
+	sub, _ := n.Listen.RegListener([]string{"PING"}, pingch)
+	defer sub.Close()
 	for !closed(pingch) {
 		select {
 		case p := <-pingch:
 			if p == nil {
 				n.l.Println("Something bad happened, ponger returning")
-				n.Disconnect("Software error")
+				go n.drop(conn, "Software error")
 				return
 			}
-			n.Pong(p.Params[0])
-		case exit := <-exch:
-			if exit {
-				return
+			token := "" //some servers ping without a token
+			if len(p.Params) > 0 {
+				token = p.Params[0]
 			}
-			continue
+			n.Pong(token)
+		case <-quit:
+			return
 		}
 	}
 	return
 }
 
 func (n *Network) logger() {
-	inch := make(chan *IrcMessage, 10)
-	outch := make(chan *IrcMessage, 10)
-	n.Listen.RegListener("*", "logger", inch)
-	n.OutListen.RegListener("*", "logger", outch)
+	inch := make(chan *IrcMessage, internalBuffer)
+	outch := make(chan *IrcMessage, internalBuffer)
+	insub, _ := n.Listen.RegListener([]string{"*"}, inch)
+	outsub, _ := n.OutListen.RegListener([]string{"*"}, outch)
 	for {
 		select {
 		case m := <-inch:
@@ -82,7 +70,7 @@ func (n *Network) logger() {
 			n.l.Printf(">>> %#v", m)
 		}
 	}
-	n.Listen.DelListener("*", "logger")
-	n.OutListen.DelListener("*", "logger")
+	insub.Close()
+	outsub.Close()
 	return
 }
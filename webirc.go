@@ -0,0 +1,64 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"net"
+	"strings"
+)
+
+//webircConf is what a gateway tells the server about the user it connects for
+type webircConf struct {
+	password string
+	gateway  string
+	hostname string
+	ip       string
+	options  []string
+}
+
+//SetWebirc makes Register send WEBIRC first, so the server shows the real
+//hostname and ip of the user behind a web gateway instead of the gateway's.
+//Options are ircv3 flags like "secure" (the user's connection to the gateway
+//uses tls) or key=value pairs. An empty password disables WEBIRC. It takes
+//effect on the next Connect.
+func (n *Network) SetWebirc(password, gateway, hostname, ip string, options ...string) os.Error {
+	if password == "" {
+		n.webirc = nil
+		return nil
+	}
+	if gateway == "" || hostname == "" {
+		return os.NewError("Empty gateway and/or hostname for WEBIRC")
+	}
+	for _, p := range []string{password, gateway, hostname} { //each must be a single middle parameter
+		if strings.IndexAny(p, " \r\n") > -1 || strings.HasPrefix(p, ":") {
+			return os.NewError(fmt.Sprintf("Bad WEBIRC parameter: %q", p))
+		}
+	}
+	if net.ParseIP(ip) == nil {
+		return os.NewError(fmt.Sprintf("Bad ip address for WEBIRC: %s", ip))
+	}
+	for _, o := range options {
+		if o == "" || strings.IndexAny(o, " \r\n") > -1 {
+			return os.NewError(fmt.Sprintf("Bad WEBIRC option: %q", o))
+		}
+	}
+	if strings.HasPrefix(ip, ":") { //would be taken for the trailing parameter
+		ip = "0" + ip
+	}
+	n.webirc = &webircConf{password, gateway, hostname, ip, options}
+	return nil
+}
+
+//Webirc sends the WEBIRC command, it has to come before anything else
+func (n *Network) Webirc() {
+	w := n.webirc
+	if w == nil {
+		return
+	}
+	msg := &IrcMessage{"", "WEBIRC", []string{w.password, w.gateway, w.hostname, w.ip}, nil}
+	if len(w.options) > 0 {
+		msg.Params = append(msg.Params, strings.Join(w.options, " "))
+	}
+	n.queueOut <- msg
+	return
+}
@@ -0,0 +1,26 @@
+package ircchans
+
+import (
+	"testing"
+)
+
+func TestSetWebirc(t *testing.T) {
+	n := NewNetwork("", "", "me", "me", "me", "", logfile)
+	if err := n.SetWebirc("secret", "gateway", "user.example", "::1", "secure"); err != nil {
+		t.Fatalf("Good WEBIRC refused: %s", err.String())
+	}
+	if n.webirc.ip != "0::1" {
+		t.Errorf("Ip taken for the trailing parameter: %s", n.webirc.ip)
+	}
+	for _, bad := range [][]string{
+		{"two words", "gateway", "user.example"},
+		{":secret", "gateway", "user.example"},
+		{"secret", "gate way", "user.example"},
+		{"secret", "gateway", ":user.example"},
+		{"secret", "gateway", "user.example\r\nQUIT"},
+	} {
+		if err := n.SetWebirc(bad[0], bad[1], bad[2], "192.0.2.1"); err == nil {
+			t.Errorf("Accepted WEBIRC %q", bad)
+		}
+	}
+}